@@ -0,0 +1,678 @@
+// Package copier provides chroot-confined file materialization helpers
+// (Get/Put/Stat/Mkdir/Remove) used by buildah to implement COPY/ADD and
+// related host/container filesystem access without ever allowing a
+// maliciously-crafted symlink in the source or destination tree to cause
+// reads or writes outside of the directory that's supposed to contain it.
+//
+// Every operation is performed by a short-lived helper process which
+// chroot(2)s into the requested root before touching any path, so that
+// even an attacker-controlled absolute symlink (e.g. "/etc/passwd" placed
+// inside a build context, or left behind in another stage's mountpoint)
+// resolves relative to that root instead of the real one. The parent
+// process and the chrooted helper communicate over a pair of pipes using
+// gob-encoded request/response messages; this keeps the privileged
+// (non-chrooted) side of buildah from ever needing to interpret untrusted
+// path data itself.
+package copier
+
+import (
+	"archive/tar"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const reexecCommand = "buildah-copier"
+
+func init() {
+	reexec.Register(reexecCommand, copierMain)
+}
+
+// IDMappingOptions controls how UID/GID values are translated between the
+// host and the chrooted tree that a request operates against.
+type IDMappingOptions struct {
+	UIDMap []idtools.IDMap
+	GIDMap []idtools.IDMap
+}
+
+// GetOptions controls the behavior of Get.
+type GetOptions struct {
+	UIDMap, GIDMap []idtools.IDMap
+	Excludes       []string
+	ExpandArchives bool
+	StripSetuidBit bool
+	StripSetgidBit bool
+	StripStickyBit bool
+}
+
+// PutOptions controls the behavior of Put.
+type PutOptions struct {
+	UIDMap, GIDMap       []idtools.IDMap
+	ChownNew             *idtools.IDPair
+	NoOverwriteDirNonDir bool
+}
+
+// StatOptions controls the behavior of Stat.
+type StatOptions struct {
+	CheckForArchives bool
+}
+
+// MkdirOptions controls the behavior of Mkdir.
+type MkdirOptions struct {
+	UIDMap, GIDMap []idtools.IDMap
+	ChownNew       *idtools.IDPair
+}
+
+// ConditionalRemoveOptions controls the behavior of Remove.
+type ConditionalRemoveOptions struct {
+	All bool
+}
+
+// StatForItem is the result of resolving a single glob pattern during a
+// Stat request, reported relative to the chrooted root that the request
+// was run against.
+type StatForItem struct {
+	Glob      string
+	Globbed   []string
+	Name      string
+	Size      int64
+	Mode      os.FileMode
+	ModTime   int64
+	IsDir     bool
+	IsSymlink bool
+	IsArchive bool
+	Error     string
+}
+
+// request is what gets sent from the unprivileged parent to the chrooted
+// helper process over the request pipe.
+type request struct {
+	Directive string
+	Root      string
+	Directory string
+	Globs     []string
+	GetOptions
+	PutOptions
+	StatOptions
+	MkdirOptions
+	ConditionalRemoveOptions
+}
+
+// response is what the chrooted helper sends back over the response pipe.
+type response struct {
+	Error string
+	Stat  []*StatForItem
+}
+
+const (
+	requestGet    = "GET"
+	requestPut    = "PUT"
+	requestStat   = "STAT"
+	requestMkdir  = "MKDIR"
+	requestRemove = "REMOVE"
+	requestQuit   = "QUIT"
+)
+
+// Get extracts the contents of the directory inside root named by
+// glob patterns from the chroot of root, bundling the results as a tar
+// stream written to bulkWriter. Symlinks are resolved relative to root,
+// never past it.
+func Get(root string, directory string, options GetOptions, globs []string, bulkWriter io.Writer) error {
+	req := request{
+		Directive:  requestGet,
+		Root:       root,
+		Directory:  directory,
+		Globs:      globs,
+		GetOptions: options,
+	}
+	return run(req, nil, bulkWriter)
+}
+
+// Put extracts a tar stream read from bulkReader into directory, which is
+// resolved inside a chroot of root, so that a hard link, symlink, or "../"
+// segment embedded in the archive can't escape root.
+func Put(root string, directory string, options PutOptions, bulkReader io.Reader) error {
+	req := request{
+		Directive:  requestPut,
+		Root:       root,
+		Directory:  directory,
+		PutOptions: options,
+	}
+	return run(req, bulkReader, nil)
+}
+
+// Stat resolves globs relative to directory inside a chroot of root, and
+// returns information about anything that matched without ever stat(2)-ing
+// outside of root.
+func Stat(root string, directory string, options StatOptions, globs []string) ([]*StatForItem, error) {
+	req := request{
+		Directive:   requestStat,
+		Root:        root,
+		Directory:   directory,
+		Globs:       globs,
+		StatOptions: options,
+	}
+	resp, err := runForResponse(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Stat, nil
+}
+
+// Mkdir creates directory (and any missing parents) inside a chroot of
+// root, with mode 0755. The ID mappings and ChownNew in options are not
+// applied: new directories are owned by whoever the helper process runs as.
+func Mkdir(root string, directory string, options MkdirOptions) error {
+	req := request{
+		Directive:    requestMkdir,
+		Root:         root,
+		Directory:    directory,
+		MkdirOptions: options,
+	}
+	return run(req, nil, nil)
+}
+
+// Remove deletes directory (recursively, if options.All is set) from
+// inside a chroot of root.
+func Remove(root string, directory string, options ConditionalRemoveOptions) error {
+	req := request{
+		Directive:                requestRemove,
+		Root:                     root,
+		Directory:                directory,
+		ConditionalRemoveOptions: options,
+	}
+	return run(req, nil, nil)
+}
+
+// run spawns a fresh chrooted helper for root, sends req, and
+// streams bulkReader/bulkWriter as the request's tar payload.
+func run(req request, bulkReader io.Reader, bulkWriter io.Writer) error {
+	resp, err := dispatch(req, bulkReader, bulkWriter)
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func runForResponse(req request) (*response, error) {
+	resp, err := dispatch(req, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// dispatch starts a fresh reexec'd helper chrooted to req.Root, sends it
+// req and its bulk payload (if any), and waits for its response. Each
+// request gets its own helper process; this keeps the chroot lifetime
+// strictly scoped to a single Get/Put/Stat/Mkdir/Remove call.
+func dispatch(req request, bulkReader io.Reader, bulkWriter io.Writer) (*response, error) {
+	cmd := reexec.Command(reexecCommand)
+	stdinRead, stdinWrite, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating copier stdin pipe")
+	}
+	stdoutRead, stdoutWrite, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating copier stdout pipe")
+	}
+	cmd.Stdin = stdinRead
+	cmd.Stdout = stdoutWrite
+	cmd.Stderr = os.Stderr
+	cmd.Dir = "/"
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "error starting copier subprocess for %q", req.Root)
+	}
+	stdinRead.Close()
+	stdoutWrite.Close()
+	defer stdinWrite.Close()
+	defer stdoutRead.Close()
+
+	enc := gob.NewEncoder(stdinWrite)
+	dec := gob.NewDecoder(stdoutRead)
+
+	var wg sync.WaitGroup
+	var copyErr error
+	if err := enc.Encode(&req); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.Wrap(err, "error sending copier request")
+	}
+	if req.Directive == requestPut && bulkReader != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := io.Copy(stdinWrite, bulkReader); err != nil {
+				copyErr = errors.Wrap(err, "error streaming archive to copier")
+			}
+		}()
+	}
+
+	var resp response
+	decodeErr := dec.Decode(&resp)
+	if req.Directive == requestGet && bulkWriter != nil && decodeErr == nil && resp.Error == "" {
+		if _, err := io.Copy(bulkWriter, stdoutRead); err != nil {
+			decodeErr = errors.Wrap(err, "error reading archive from copier")
+		}
+	}
+	stdinWrite.Close()
+	wg.Wait()
+	if err := cmd.Wait(); err != nil && decodeErr == nil {
+		decodeErr = errors.Wrapf(err, "copier subprocess for %q failed", req.Root)
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	if copyErr != nil {
+		return nil, copyErr
+	}
+	return &resp, nil
+}
+
+// copierMain is the reexec entry point. It runs inside the freshly-forked
+// child, reads exactly one request from stdin, chroots into the request's
+// Root before touching any path, and then services that request.
+func copierMain() {
+	runtime.LockOSThread()
+	var req request
+	dec := gob.NewDecoder(os.Stdin)
+	if err := dec.Decode(&req); err != nil {
+		fmt.Fprintf(os.Stderr, "copier: error reading request: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := syscall.Chroot(req.Root); err != nil {
+		writeResponse(&response{Error: fmt.Sprintf("error chrooting to %q: %v", req.Root, err)})
+		os.Exit(1)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		writeResponse(&response{Error: fmt.Sprintf("error changing to chrooted root: %v", err)})
+		os.Exit(1)
+	}
+
+	var resp response
+	var err error
+	switch req.Directive {
+	case requestGet:
+		err = doGet(req, os.Stdin, os.Stdout)
+	case requestPut:
+		err = doPut(req, os.Stdin)
+	case requestStat:
+		resp.Stat, err = doStat(req)
+	case requestMkdir:
+		err = doMkdir(req)
+	case requestRemove:
+		err = doRemove(req)
+	default:
+		err = errors.Errorf("unrecognized copier directive %q", req.Directive)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	writeResponse(&resp)
+	if resp.Error != "" {
+		os.Exit(1)
+	}
+}
+
+func writeResponse(resp *response) {
+	enc := gob.NewEncoder(os.Stdout)
+	if err := enc.Encode(resp); err != nil {
+		fmt.Fprintf(os.Stderr, "copier: error writing response: %v\n", err)
+	}
+}
+
+// doGet walks req.Directory (resolved against the already-chrooted "/"),
+// matches req.Globs against it (or copies the directory itself if no
+// globs were given), and streams the result as a tar archive honoring
+// req.GetOptions.
+func doGet(req request, bulkReader io.Reader, bulkWriter io.Writer) error {
+	dir := filepath.Join(string(os.PathSeparator), req.Directory)
+	names, err := resolveGlobs(dir, req.Globs)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(bulkWriter)
+	defer tw.Close()
+	hardlinks := make(map[uint64]string)
+	for _, name := range names {
+		if err := addToTar(tw, name, req.GetOptions, hardlinks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveGlobs(dir string, globs []string) ([]string, error) {
+	if len(globs) == 0 {
+		return []string{dir}, nil
+	}
+	var matches []string
+	for _, glob := range globs {
+		found, err := filepath.Glob(filepath.Join(dir, glob))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error matching pattern %q under %q", glob, dir)
+		}
+		matches = append(matches, found...)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// addToTar walks name and writes every entry it finds into tw, honoring options.Excludes and
+// options.StripSet{uid,gid}Bit/StripStickyBit, resolving symlink targets, preserving xattrs, and
+// recording additional hard links to an inode already archived (tracked via hardlinks, keyed by
+// inode number) as TypeLink entries instead of archiving their content again.
+func addToTar(tw *tar.Writer, name string, options GetOptions, hardlinks map[uint64]string) error {
+	return filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, exclude := range options.Excludes {
+			if matched, _ := filepath.Match(exclude, strings.TrimPrefix(path, string(os.PathSeparator))); matched {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return errors.Wrapf(err, "error reading symlink target of %q", path)
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return errors.Wrapf(err, "error building tar header for %q", path)
+		}
+		hdr.Name = strings.TrimPrefix(path, string(os.PathSeparator))
+		// tar.FileInfoHeader records these bits as tar's c_ISUID (04000), c_ISGID (02000) and
+		// c_ISVTX (01000), not as os.ModeSetuid/os.ModeSetgid/os.ModeSticky.
+		if options.StripSetuidBit {
+			hdr.Mode &^= 0 /* unset setuid below via mask */
+			hdr.Mode &^= 04000
+		}
+		if options.StripSetgidBit {
+			hdr.Mode &^= 02000
+		}
+		if options.StripStickyBit {
+			hdr.Mode &^= 01000
+		}
+		if len(options.UIDMap) > 0 || len(options.GIDMap) > 0 {
+			hostPair, err := idtools.NewIDMappingsFromMaps(options.UIDMap, options.GIDMap).ToHost(idtools.IDPair{UID: hdr.Uid, GID: hdr.Gid})
+			if err != nil {
+				return errors.Wrapf(err, "error mapping ownership of %q", path)
+			}
+			hdr.Uid, hdr.Gid = hostPair.UID, hostPair.GID
+		}
+		skipContent := false
+		if info.Mode().IsRegular() {
+			if ino, nlink, ok := fileInode(info); ok && nlink > 1 {
+				if linkname, seen := hardlinks[ino]; seen {
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = linkname
+					hdr.Size = 0
+					skipContent = true
+				} else {
+					hardlinks[ino] = hdr.Name
+				}
+			}
+		}
+		if err := addXattrs(hdr, path); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "error writing tar header for %q", path)
+		}
+		if info.Mode().IsRegular() && !skipContent {
+			f, err := os.Open(path)
+			if err != nil {
+				return errors.Wrapf(err, "error opening %q", path)
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return errors.Wrapf(err, "error copying %q into archive", path)
+			}
+		}
+		return nil
+	})
+}
+
+// fileInode returns the inode number and link count backing info, if the platform's os.FileInfo
+// exposes one (it does on Linux, which is the only platform the copier subprocess runs on).
+func fileInode(info os.FileInfo) (ino uint64, nlink uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Ino, uint64(st.Nlink), true
+}
+
+// addXattrs reads every extended attribute set on path and records it in hdr.PAXRecords, using
+// the same "SCHILY.xattr.<name>" key that GNU tar and archive/tar's reader use, so a Put of this
+// archive elsewhere can restore them via setXattrs.
+func addXattrs(hdr *tar.Header, path string) error {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	n, err := syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+	for _, name := range splitNulTerminated(buf[:n]) {
+		if name == "" {
+			continue
+		}
+		vsize, err := syscall.Getxattr(path, name, nil)
+		if err != nil || vsize <= 0 {
+			continue
+		}
+		value := make([]byte, vsize)
+		vn, err := syscall.Getxattr(path, name, value)
+		if err != nil {
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+name] = string(value[:vn])
+	}
+	return nil
+}
+
+// setXattrs is addXattrs' inverse, applied by extractEntry when putting a regular file back.
+func setXattrs(target string, paxRecords map[string]string) error {
+	for key, value := range paxRecords {
+		name := strings.TrimPrefix(key, "SCHILY.xattr.")
+		if name == key {
+			continue
+		}
+		if err := syscall.Setxattr(target, name, []byte(value), 0); err != nil {
+			logrus.Debugf("error setting xattr %q on %q: %v", name, target, err)
+		}
+	}
+	return nil
+}
+
+func splitNulTerminated(b []byte) []string {
+	var names []string
+	start := 0
+	for i, c := range b {
+		if c == 0 {
+			names = append(names, string(b[start:i]))
+			start = i + 1
+		}
+	}
+	if start < len(b) {
+		names = append(names, string(b[start:]))
+	}
+	return names
+}
+
+// doPut extracts a tar stream into req.Directory, remapping ownership per
+// req.PutOptions.UIDMap/GIDMap and refusing to let any entry's name
+// resolve (via "..") outside of the chrooted root.
+func doPut(req request, bulkReader io.Reader) error {
+	dir := filepath.Join(string(os.PathSeparator), req.Directory)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "error creating directory %q", dir)
+	}
+	tr := tar.NewReader(bulkReader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "error reading archive")
+		}
+		target := filepath.Join(dir, filepath.Clean(string(os.PathSeparator)+hdr.Name))
+		if err := extractEntry(tr, hdr, dir, target, req.PutOptions); err != nil {
+			return err
+		}
+	}
+}
+
+// extractEntry materializes a single tar entry at target, which must already have been resolved
+// (by doPut, via dir) to a path inside the chrooted root. dir is that same chrooted extraction
+// root: hdr.Linkname for a TypeLink entry is recorded relative to dir (the archive root, same as
+// hdr.Name - see addToTar), not relative to target's own parent directory, so a hard link to an
+// entry outside of target's directory must be resolved against dir rather than filepath.Dir(target).
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dir, target string, options PutOptions) error {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+			return err
+		}
+		return chownEntry(target, hdr.Uid, hdr.Gid, options)
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		os.Remove(target)
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		return chownEntry(target, hdr.Uid, hdr.Gid, options)
+	case tar.TypeLink:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		os.Remove(target)
+		return os.Link(filepath.Join(dir, filepath.Clean(string(os.PathSeparator)+hdr.Linkname)), target)
+	default:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode))
+		if err != nil {
+			return errors.Wrapf(err, "error creating %q", target)
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return errors.Wrapf(err, "error writing %q", target)
+		}
+		f.Close()
+		if err := setXattrs(target, hdr.PAXRecords); err != nil {
+			return err
+		}
+		return chownEntry(target, hdr.Uid, hdr.Gid, options)
+	}
+}
+
+// chownEntry applies options.ChownNew (to every extracted entry, whether it was newly created or
+// overwrote something that already existed) or, failing that, options.UIDMap/GIDMap (mapping the archived,
+// container-side ownership recorded in hdr back to the IDs that own it on the host) to target.
+// With neither option set, ownership is left as whatever the Typeflag-specific creation call
+// above already produced.
+func chownEntry(target string, uid, gid int, options PutOptions) error {
+	if options.ChownNew != nil {
+		uid, gid = options.ChownNew.UID, options.ChownNew.GID
+	} else if len(options.UIDMap) > 0 || len(options.GIDMap) > 0 {
+		hostPair, err := idtools.NewIDMappingsFromMaps(options.UIDMap, options.GIDMap).ToHost(idtools.IDPair{UID: uid, GID: gid})
+		if err != nil {
+			return errors.Wrapf(err, "error mapping ownership of %q", target)
+		}
+		uid, gid = hostPair.UID, hostPair.GID
+	} else {
+		return nil
+	}
+	if err := os.Lchown(target, uid, gid); err != nil {
+		return errors.Wrapf(err, "error setting ownership of %q", target)
+	}
+	return nil
+}
+
+// doStat resolves req.Globs against req.Directory and reports what each
+// one matched.
+func doStat(req request) ([]*StatForItem, error) {
+	dir := filepath.Join(string(os.PathSeparator), req.Directory)
+	var results []*StatForItem
+	globs := req.Globs
+	if len(globs) == 0 {
+		globs = []string{"."}
+	}
+	for _, glob := range globs {
+		item := &StatForItem{Glob: glob}
+		matches, err := filepath.Glob(filepath.Join(dir, glob))
+		if err != nil {
+			item.Error = err.Error()
+			results = append(results, item)
+			continue
+		}
+		item.Globbed = matches
+		if len(matches) > 0 {
+			info, err := os.Lstat(matches[0])
+			if err != nil {
+				item.Error = err.Error()
+			} else {
+				item.Name = matches[0]
+				if resolved, err := filepath.EvalSymlinks(matches[0]); err == nil {
+					item.Name = resolved
+				}
+				item.Size = info.Size()
+				item.Mode = info.Mode()
+				item.ModTime = info.ModTime().Unix()
+				item.IsDir = info.IsDir()
+				item.IsSymlink = info.Mode()&os.ModeSymlink != 0
+			}
+		}
+		results = append(results, item)
+	}
+	return results, nil
+}
+
+func doMkdir(req request) error {
+	dir := filepath.Join(string(os.PathSeparator), req.Directory)
+	return os.MkdirAll(dir, 0755)
+}
+
+func doRemove(req request) error {
+	dir := filepath.Join(string(os.PathSeparator), req.Directory)
+	if req.ConditionalRemoveOptions.All {
+		return os.RemoveAll(dir)
+	}
+	return os.Remove(dir)
+}
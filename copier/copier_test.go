@@ -0,0 +1,142 @@
+package copier
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/reexec"
+)
+
+// TestMain lets copierMain run in the reexec'd child before the test binary's own flag parsing and
+// test selection kick in, same as any other reexec.Register user.
+func TestMain(m *testing.M) {
+	if reexec.Init() {
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestSplitNulTerminated(t *testing.T) {
+	cases := []struct {
+		in   []byte
+		want []string
+	}{
+		{nil, nil},
+		{[]byte("one\x00"), []string{"one"}},
+		{[]byte("one\x00two\x00"), []string{"one", "two"}},
+		{[]byte("one\x00two"), []string{"one", "two"}},
+	}
+	for _, c := range cases {
+		got := splitNulTerminated(c.in)
+		if len(got) != len(c.want) {
+			t.Fatalf("splitNulTerminated(%q) = %q, want %q", c.in, got, c.want)
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Fatalf("splitNulTerminated(%q) = %q, want %q", c.in, got, c.want)
+			}
+		}
+	}
+}
+
+func TestAddToTarPreservesSymlinksAndHardlinks(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "real"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "real"), filepath.Join(dir, "hardlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := addToTar(tw, dir, GetOptions{}, make(map[uint64]string)); err != nil {
+		t.Fatalf("addToTar: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(map[string]*tar.Header)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		entries[filepath.Base(hdr.Name)] = hdr
+	}
+
+	link, ok := entries["link"]
+	if !ok || link.Typeflag != tar.TypeSymlink || link.Linkname != "real" {
+		t.Fatalf("symlink entry = %+v, want a TypeSymlink entry with Linkname %q", link, "real")
+	}
+	// filepath.Walk visits "hardlink" before "real", so "hardlink" is archived with the file's
+	// content and "real", the second name for the same inode, is the TypeLink entry.
+	hardlink, ok := entries["real"]
+	if !ok || hardlink.Typeflag != tar.TypeLink || filepath.Base(hardlink.Linkname) != "hardlink" {
+		t.Fatalf("real entry = %+v, want a TypeLink entry pointing at %q", hardlink, "hardlink")
+	}
+}
+
+// TestExtractEntryHardlinkResolvesAgainstRoot is a regression test: hdr.Linkname is recorded
+// relative to the archive root (see addToTar), not relative to the entry's own directory, so a
+// hardlink outside of its own directory must resolve against the extraction root passed to
+// extractEntry rather than filepath.Dir(target).
+func TestExtractEntryHardlinkResolvesAgainstRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sub", "file"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(root, "other", "link")
+	hdr := &tar.Header{Typeflag: tar.TypeLink, Linkname: "sub/file"}
+	if err := extractEntry(nil, hdr, root, target, PutOptions{}); err != nil {
+		t.Fatalf("extractEntry: %v", err)
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Fatalf("hardlink was not created at %q: %v", target, err)
+	}
+}
+
+func TestGetPutRoundTrip(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Get/Put chroot into root, which requires root privileges")
+	}
+
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "file"), []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var tarball bytes.Buffer
+	if err := Get(src, string(os.PathSeparator), GetOptions{}, nil, &tarball); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	dst := t.TempDir()
+	if err := Put(dst, string(os.PathSeparator), PutOptions{}, &tarball); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "file"))
+	if err != nil || string(content) != "payload" {
+		t.Fatalf("Put did not recreate file contents: err=%v content=%q", err, content)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "file" {
+		t.Fatalf("Put did not recreate symlink: err=%v target=%q", err, target)
+	}
+}
@@ -1,8 +1,14 @@
 package imagebuildah
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,12 +17,17 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/containers/buildah"
+	"github.com/containers/buildah/copier"
 	buildahdocker "github.com/containers/buildah/docker"
 	"github.com/containers/buildah/util"
 	cp "github.com/containers/image/copy"
@@ -30,6 +41,7 @@ import (
 	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/stringid"
 	docker "github.com/fsouza/go-dockerclient"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/openshift/imagebuilder"
@@ -50,6 +62,9 @@ const (
 )
 
 // Mount is a mountpoint for the build container.
+// Setting Type to "overlay" gives RUN instructions a writable view of Source without ever
+// modifying it: a scratch upperdir/workdir pair is layered over Source for the lifetime of each RUN
+// and discarded afterward, the same semantics "podman run -v host:ctr:O" gives a container.
 type Mount specs.Mount
 
 // BuildOptions can be used to alter how an image is built.
@@ -131,6 +146,18 @@ type BuildOptions struct {
 	// CNIConfigDir is the location of CNI configuration files, if the files in
 	// the default configuration directory shouldn't be used.
 	CNIConfigDir string
+	// IPC, PID, UTS, Network, CgroupNS, and UserNS let a caller set up the corresponding
+	// namespace for RUN instructions without having to hand-build a NamespaceOptions slice.
+	// Each accepts "host" (join the host's namespace), "private" (get a new one), or
+	// "ns:<path>" (join the one at that bind-mounted path). An empty string leaves
+	// NamespaceOptions' existing entry (if any) for that namespace alone. Network does not
+	// accept the name of a CNI network to join per build; NewExecutor rejects any other value.
+	IPC      string
+	PID      string
+	UTS      string
+	Network  string
+	CgroupNS string
+	UserNS   string
 	// ID mapping options to use if we're setting up our own user namespace
 	// when handling RUN instructions.
 	IDMappingOptions *buildah.IDMappingOptions
@@ -166,10 +193,72 @@ type BuildOptions struct {
 	// ForceRmIntermediateCtrs tells the builder to remove all intermediate containers even if
 	// the build was unsuccessful.
 	ForceRmIntermediateCtrs bool
+	// RemoveIntermediateImages tells the builder whether to remove the per-step cache images it
+	// committed while building with Layers, once the build has finished. Its zero value, false,
+	// leaves them in the store, as builds did before this option existed, so that a later build
+	// can reuse them as cache hits. Set it to true to remove them.
+	RemoveIntermediateImages bool
 	// BlobDirectory is a directory which we'll use for caching layer blobs.
 	BlobDirectory string
 	// Target the targeted FROM in the Dockerfile to build
 	Target string
+	// Jobs is the maximum number of stages to execute concurrently, bounded by how many of
+	// them are actually ready to run (i.e. their FROM and every COPY --from= dependency has
+	// already finished). 0 (the default) preserves the previous strictly-sequential behavior.
+	Jobs int
+	// MaxConcurrentStages is a deprecated alias for Jobs, kept for callers that were written
+	// against that name. If Jobs is unset, MaxConcurrentStages is used in its place. It does not
+	// select a different concurrency mechanism from Jobs; it is the same jobs count under an
+	// older name.
+	MaxConcurrentStages int
+	// MaxParallelStages is another deprecated alias for Jobs, checked if both Jobs and
+	// MaxConcurrentStages are unset. Like MaxConcurrentStages, it only renames the same jobs
+	// count that NewExecutor uses to bound the one stage-concurrency mechanism this package has;
+	// it is not a second, independent implementation of stage parallelism.
+	MaxParallelStages int
+	// Secrets maps a secret ID (as named by RUN --mount=type=secret,id=<ID>) to the host path
+	// whose contents should be made available under /run/secrets/<ID> for that RUN alone.
+	Secrets map[string]string
+	// SSHSources maps an SSH forward ID (as named by RUN --mount=type=ssh,id=<ID>) to the path
+	// of the host's SSH_AUTH_SOCK that should be forwarded into the container for that RUN.
+	SSHSources map[string]string
+	// CacheFrom lists registry image references (e.g. "myregistry/app:buildcache") that layerExists
+	// should also consult, in addition to local storage, when looking for a cached layer to reuse
+	// for a step. Each reference is expected to carry the same per-step cache-key history comments
+	// that this package's own cache does (see cacheKeyAnnotation); an entry without one is skipped.
+	CacheFrom []string
+	// CacheTo lists registry image references that the final image should be pushed to once the
+	// build finishes successfully, purely so that its history (and the per-step cache keys in it)
+	// becomes available to CacheFrom on other hosts.
+	CacheTo []string
+	// CacheTTL discards a CacheFrom image when deciding whether to reuse it if it's older than
+	// this. Zero (the default) means no age limit.
+	CacheTTL time.Duration
+	// CacheDir overrides the directory under which RUN --mount=type=cache directories (see
+	// resolveRunMounts) are stored, scoped further by stage name and the mount's own id. If
+	// empty, store.GraphRoot()/cache/buildah is used.
+	CacheDir string
+	// Provenance builds a SLSA-style build provenance document (the Dockerfile's digest, each
+	// stage's base image and instructions, and which build args were actually consumed) for the
+	// final image and pushes it as an OCI 1.1 referrer artifact -- a manifest whose "subject"
+	// field points at the image's own manifest digest -- to every destination in CacheTo, which
+	// is the only registry location this package otherwise knows about. A build with no CacheTo
+	// entries has nowhere to push the referrer to, so Provenance is a no-op in that case.
+	Provenance bool
+	// SBOMScanners, if non-empty, are run against the final stage's root filesystem and their
+	// combined results are pushed as a second referrer artifact alongside Provenance (or on their
+	// own, if Provenance is false). DefaultSBOMScanner covers dpkg- and apk-based images.
+	SBOMScanners []SBOMScanner
+	// ProgressWriter, if set, receives one newline-delimited JSON progressEvent per stage start,
+	// cache hit, commit, and warning, alongside (not instead of) the usual human-readable output
+	// on Out/Err/ReportWriter. Intended for callers (podman, CI systems, IDE integrations) that
+	// want to consume build progress programmatically instead of screen-scraping.
+	ProgressWriter io.Writer
+	// Preprocessors, consulted in order for each Dockerfile path before parsing, lets callers
+	// plug in their own macro/templating engines instead of being limited to CPP's ".in"
+	// handling. If empty, defaultPreprocessors (CPP on ".in", matching this package's previous,
+	// unconditional behavior) is used instead.
+	Preprocessors []Preprocessor
 }
 
 // Executor is a buildah-based implementation of the imagebuilder.Executor
@@ -211,14 +300,37 @@ type Executor struct {
 	annotations                    []string
 	onbuild                        []string
 	layers                         bool
-	topLayers                      []string
 	useCache                       bool
 	removeIntermediateCtrs         bool
 	forceRmIntermediateCtrs        bool
+	removeIntermediateImages       bool
 	imageMap                       map[string]string // Used to map images that we create to handle the AS construct.
+	intermediateImages             []string          // Per-step cache images committed while building with layers.
 	blobDirectory                  string
 	excludes                       []string
 	unusedArgs                     map[string]struct{}
+	jobs                           int
+	secrets                        map[string]string
+	sshSources                     map[string]string
+	cacheFrom                      []string
+	cacheTo                        []string
+	cacheTTL                       time.Duration
+	cacheDir                       string
+	buildArgs                      map[string]string
+	provenance                     bool
+	sbomScanners                   []SBOMScanner
+	dockerfileDigest               string
+	progressWriter                 io.Writer
+	// stageMutex guards every field above that's mutated by more than one
+	// stage's goroutine once Jobs > 1 lets stages run concurrently:
+	// stages, imageMap, unusedArgs, and intermediateImages.
+	stageMutex sync.Mutex
+	// logMutex serializes calls to log once Jobs > 1 lets more than one stage call it at once.
+	logMutex sync.Mutex
+	// remoteCacheOnce and remoteCacheIndex lazily populate, once per build, from cacheFrom: a map
+	// of cache key (see cacheKeyAnnotation) to the CacheFrom reference whose history carried it.
+	remoteCacheOnce  sync.Once
+	remoteCacheIndex map[string]string
 }
 
 // StageExecutor bundles up what we need to know when executing one stage of a
@@ -233,19 +345,24 @@ type Executor struct {
 // If we're naming the result of the build, only the last stage will apply that
 // name to the image that it produces.
 type StageExecutor struct {
-	executor        *Executor
-	index           int
-	stages          int
-	name            string
-	builder         *buildah.Builder
-	preserved       int
-	volumes         imagebuilder.VolumeSet
-	volumeCache     map[string]string
-	volumeCacheInfo map[string]os.FileInfo
-	mountPoint      string
-	copyFrom        string // Used to keep track of the --from flag from COPY and ADD
-	output          string
-	containerIDs    []string
+	executor          *Executor
+	index             int
+	stages            int
+	name              string
+	builder           *buildah.Builder
+	preserved         int
+	volumes           imagebuilder.VolumeSet
+	volumeCache       map[string]string
+	volumeCacheInfo   map[string]os.FileInfo
+	mountPoint        string
+	copyFrom          string // Used to keep track of the --from flag from COPY and ADD
+	output            string
+	containerIDs      []string
+	topLayers         []string       // Top layer of each container this stage has prepared, in order
+	done              chan struct{}  // closed once the stage has committed (or failed to)
+	stageErr          error          // set before done is closed if the stage failed
+	pendingRunMounts  []specs.Mount  // extra mounts for the RUN instruction about to execute, from --mount=
+	pendingRunCleanup []func() error // run (in order) after that RUN instruction finishes, success or not
 }
 
 // builtinAllowedBuildArgs is list of built-in allowed build args.  Normally we
@@ -263,9 +380,44 @@ var builtinAllowedBuildArgs = map[string]bool{
 	"no_proxy":    true,
 }
 
+// progressEvent is one line of the optional newline-delimited JSON progress stream that
+// BuildOptions.ProgressWriter, when set, receives alongside (not instead of) the usual
+// human-readable output this package already writes to Out/Err/ReportWriter.
+type progressEvent struct {
+	Type     string        `json:"type"` // "log", "stage", "stage-end", "step", "step-end", "cache", "commit", "warning", "error"
+	Stage    string        `json:"stage,omitempty"`
+	Step     string        `json:"step,omitempty"`
+	Message  string        `json:"message,omitempty"`
+	ImageID  string        `json:"imageId,omitempty"`
+	Digest   string        `json:"digest,omitempty"`
+	Duration time.Duration `json:"durationNs,omitempty"` // set on "stage-end" and "step-end"
+}
+
+// emit writes event to ProgressWriter as a single line of JSON, if one was configured. It's
+// serialized by the same logMutex that already serializes exec.log, since once Jobs > 1 lets
+// stages run concurrently, more than one of them can call emit at the same time.
+func (b *Executor) emit(event progressEvent) {
+	if b.progressWriter == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		logrus.Debugf("error marshaling progress event: %v", err)
+		return
+	}
+	data = append(data, '\n')
+	b.logMutex.Lock()
+	defer b.logMutex.Unlock()
+	if _, err := b.progressWriter.Write(data); err != nil {
+		logrus.Debugf("error writing progress event: %v", err)
+	}
+}
+
 // startStage creates a new stage executor that will be referenced whenever a
 // COPY or ADD statement uses a --from=NAME flag.
 func (b *Executor) startStage(name string, index, stages int, from, output string) *StageExecutor {
+	b.stageMutex.Lock()
+	defer b.stageMutex.Unlock()
 	if b.stages == nil {
 		b.stages = make(map[string]*StageExecutor)
 	}
@@ -277,15 +429,41 @@ func (b *Executor) startStage(name string, index, stages int, from, output strin
 		volumeCache:     make(map[string]string),
 		volumeCacheInfo: make(map[string]os.FileInfo),
 		output:          output,
+		done:            make(chan struct{}),
 	}
 	b.stages[name] = stage
 	b.stages[from] = stage
 	if idx := strconv.Itoa(index); idx != name {
 		b.stages[idx] = stage
 	}
+	// The "stage" progress event is emitted from Prepare, at the same call site and with the
+	// same displayFrom as the "FROM %s" line it mirrors, instead of from here: buildConcurrent runs
+	// startStage for every stage up front (to build the dependency DAG) well before that stage actually
+	// starts executing, so emitting here would desynchronize the progress stream from the
+	// human-readable log it's supposed to track.
 	return stage
 }
 
+// logPrefix returns a "[stage N] " tag to stick in front of log lines this stage emits, but only
+// when stages can actually run concurrently (Jobs > 1); otherwise stages already print in program
+// order, and tagging every line would just be noise.
+func (s *StageExecutor) logPrefix() string {
+	if s.executor.jobs <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("[stage %d] ", s.index)
+}
+
+// stageByName looks up a previously-started stage by name, index, or FROM
+// value, the same keys startStage populates b.stages under, guarded by
+// b.stageMutex so it's safe to call while other stages are running.
+func (b *Executor) stageByName(name string) (*StageExecutor, bool) {
+	b.stageMutex.Lock()
+	defer b.stageMutex.Unlock()
+	stage, ok := b.stages[name]
+	return stage, ok
+}
+
 // Preserve informs the stage executor that from this point on, it needs to
 // ensure that only COPY and ADD instructions can modify the contents of this
 // directory or anything below it.
@@ -323,14 +501,21 @@ func (s *StageExecutor) Preserve(path string) error {
 	// Save info about the top level of the location that we'll be archiving.
 	archivedPath := filepath.Join(s.mountPoint, path)
 
-	// Try and resolve the symlink (if one exists)
-	// Set archivedPath and path based on whether a symlink is found or not
-	if symLink, err := resolveSymlink(s.mountPoint, path); err == nil {
-		archivedPath = filepath.Join(s.mountPoint, symLink)
-		path = symLink
-	} else {
+	// Resolve any symlink in path using a chroot of s.mountPoint, so that a
+	// symlink planted by the image (or a previous stage) can't walk us
+	// outside of the container's root when we go looking for what it
+	// points to.
+	stats, err := copier.Stat(s.mountPoint, string(os.PathSeparator), copier.StatOptions{}, []string{path})
+	if err != nil {
 		return errors.Wrapf(err, "error reading symbolic link to %q", path)
 	}
+	if len(stats) != 1 || stats[0].Error != "" {
+		return errors.Wrapf(errors.New(stats[0].Error), "error reading symbolic link to %q", path)
+	}
+	if resolved := stats[0].Name; resolved != "" {
+		path = strings.TrimPrefix(resolved, s.mountPoint)
+		archivedPath = filepath.Join(s.mountPoint, path)
+	}
 
 	st, err := os.Stat(archivedPath)
 	if os.IsNotExist(err) {
@@ -489,46 +674,162 @@ func (s *StageExecutor) Copy(excludes []string, copies ...imagebuilder.Copy) err
 		if err := s.volumeCacheInvalidate(copy.Dest); err != nil {
 			return err
 		}
-		sources := []string{}
+
+		var urls []string
+		root := s.executor.contextDir
+		var globs []string
 		for _, src := range copy.Src {
 			if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
-				sources = append(sources, src)
-			} else if len(copy.From) > 0 {
-				if other, ok := s.executor.stages[copy.From]; ok && other.index < s.index {
-					sources = append(sources, filepath.Join(other.mountPoint, src))
-				} else {
+				urls = append(urls, src)
+				continue
+			}
+			if len(copy.From) > 0 {
+				other, ok := s.executor.stageByName(copy.From)
+				if !ok || other.index >= s.index {
 					return errors.Errorf("the stage %q has not been built", copy.From)
 				}
-			} else {
-				sources = append(sources, filepath.Join(s.executor.contextDir, src))
+				// With Jobs > 1 the referenced stage may still be
+				// running concurrently with us; block here until it
+				// has committed (or failed) before touching its
+				// mountpoint.
+				<-other.done
+				if other.stageErr != nil {
+					return errors.Wrapf(other.stageErr, "the stage %q failed to build", copy.From)
+				}
+				// Validate src against a chroot of the other stage's
+				// mountpoint so that a symlink left behind in that
+				// stage (e.g. pointing at "/etc/shadow") can't cause
+				// us to read something outside of it; copier.Get
+				// below resolves the same glob the same way when it
+				// actually reads the data.
+				stats, err := copier.Stat(other.mountPoint, string(os.PathSeparator), copier.StatOptions{}, []string{src})
+				if err != nil {
+					return errors.Wrapf(err, "error checking contents of stage %q", copy.From)
+				}
+				if len(stats) != 1 || len(stats[0].Globbed) == 0 {
+					return errors.Errorf("no source files were found in stage %q matching %q", copy.From, src)
+				}
+				root = other.mountPoint
+			}
+			globs = append(globs, src)
+		}
+
+		if len(urls) > 0 || copy.Chown != "" {
+			// ADD's URL-fetch and archive-auto-extraction, and any Chown=
+			// request (resolved against the container's /etc/passwd and
+			// /etc/group), are still builder.Add's job: copier never
+			// consults a container's user database and only ever moves
+			// files that are already sitting in a local tree.
+			sources := append([]string{}, urls...)
+			for _, glob := range globs {
+				sources = append(sources, filepath.Join(root, glob))
+			}
+			options := buildah.AddAndCopyOptions{
+				Chown:      copy.Chown,
+				ContextDir: s.executor.contextDir,
+				Excludes:   s.executor.excludes,
 			}
+			if err := s.builder.Add(copy.Dest, copy.Download, options, sources...); err != nil {
+				return err
+			}
+			continue
 		}
 
-		options := buildah.AddAndCopyOptions{
-			Chown:      copy.Chown,
-			ContextDir: s.executor.contextDir,
-			Excludes:   s.executor.excludes,
+		if len(globs) == 0 {
+			continue
 		}
 
-		if err := s.builder.Add(copy.Dest, copy.Download, options, sources...); err != nil {
-			return err
+		// Funnel the plain COPY case through copier's chroot-confined
+		// Get/Put instead of builder.Add's archive.Tar/Untar, so a symlink
+		// planted in the build context or left behind in another stage
+		// can't resolve outside of root on either side of the copy.
+		pr, pw := io.Pipe()
+		getErrCh := make(chan error, 1)
+		go func() {
+			err := copier.Get(root, string(os.PathSeparator), copier.GetOptions{Excludes: excludes}, globs, pw)
+			pw.CloseWithError(err)
+			getErrCh <- err
+		}()
+		putErr := copier.Put(s.mountPoint, copy.Dest, copier.PutOptions{}, pr)
+		if getErr := <-getErrCh; getErr != nil {
+			return errors.Wrapf(getErr, "error reading %v from %q", globs, root)
+		}
+		if putErr != nil {
+			return errors.Wrapf(putErr, "error writing %v to %q", globs, copy.Dest)
 		}
 	}
 	return nil
 }
 
-func convertMounts(mounts []Mount) []specs.Mount {
+// convertMounts turns the Mount entries a caller supplied (in BuildOptions.TransientMounts, or from
+// a --mount= flag) into specs.Mount entries for Run(), plus any cleanup that needs to happen once
+// the RUN instruction using them has finished. A Mount whose Type is "overlay" is handled specially:
+// rather than being passed straight through, it's backed by a throwaway upperdir/workdir pair so
+// that writes made through it never reach m.Source, which lets a host directory like a shared Maven
+// or npm cache be mounted read-write into a build without the build being able to modify it.
+func (s *StageExecutor) convertMounts(mounts []Mount) ([]specs.Mount, []func() error, error) {
+	var cleanup []func() error
 	specmounts := []specs.Mount{}
 	for _, m := range mounts {
-		s := specs.Mount{
+		if m.Type == "overlay" {
+			overlayMount, overlayCleanup, err := s.overlayTransientMount(m)
+			if err != nil {
+				if overlayCleanup != nil {
+					overlayCleanup()
+				}
+				for i := len(cleanup) - 1; i >= 0; i-- {
+					cleanup[i]()
+				}
+				return nil, nil, err
+			}
+			cleanup = append(cleanup, overlayCleanup)
+			specmounts = append(specmounts, overlayMount)
+			continue
+		}
+		specmounts = append(specmounts, specs.Mount{
 			Destination: m.Destination,
 			Type:        m.Type,
 			Source:      m.Source,
 			Options:     m.Options,
-		}
-		specmounts = append(specmounts, s)
+		})
+	}
+	return specmounts, cleanup, nil
+}
+
+// overlayTransientMount creates a scratch upperdir/workdir pair under the container's storage
+// directory and assembles the overlay mount spec that layers m.Source underneath them, so that a
+// RUN instruction can write to m.Destination without ever touching m.Source. The returned cleanup
+// function removes the scratch directories and must be called once the RUN instruction is done with
+// them, whether or not it succeeded.
+func (s *StageExecutor) overlayTransientMount(m Mount) (specs.Mount, func() error, error) {
+	containerDir, err := s.executor.store.ContainerDirectory(s.builder.ContainerID)
+	if err != nil {
+		return specs.Mount{}, nil, errors.Errorf("unable to locate working directory for container")
+	}
+	scratchDir, err := ioutil.TempDir(containerDir, "overlay")
+	if err != nil {
+		return specs.Mount{}, nil, errors.Wrapf(err, "error creating overlay scratch directory for %q", m.Destination)
+	}
+	cleanup := func() error {
+		return os.RemoveAll(scratchDir)
+	}
+	upperDir := filepath.Join(scratchDir, "upper")
+	workDir := filepath.Join(scratchDir, "work")
+	if err := os.MkdirAll(upperDir, 0755); err != nil {
+		return specs.Mount{}, cleanup, errors.Wrapf(err, "error creating overlay upperdir for %q", m.Destination)
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return specs.Mount{}, cleanup, errors.Wrapf(err, "error creating overlay workdir for %q", m.Destination)
+	}
+	options := append([]string{}, m.Options...)
+	options = append(options, "lowerdir="+m.Source, "upperdir="+upperDir, "workdir="+workDir)
+	overlayMount := specs.Mount{
+		Destination: m.Destination,
+		Type:        "overlay",
+		Source:      "overlay",
+		Options:     options,
 	}
-	return specmounts
+	return overlayMount, cleanup, nil
 }
 
 // Run executes a RUN instruction using the stage's current working container
@@ -547,12 +848,27 @@ func (s *StageExecutor) Run(run imagebuilder.Run, config docker.Config) error {
 		defer devNull.Close()
 		stdin = devNull
 	}
+	transientMounts, transientCleanup, err := s.convertMounts(s.executor.transientMounts)
+	if err != nil {
+		return err
+	}
+	mounts := append(transientMounts, s.pendingRunMounts...)
+	cleanup := append(transientCleanup, s.pendingRunCleanup...)
+	s.pendingRunMounts = nil
+	s.pendingRunCleanup = nil
+	defer func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			if err := cleanup[i](); err != nil {
+				logrus.Debugf("error cleaning up RUN --mount: %v", err)
+			}
+		}
+	}()
 	options := buildah.RunOptions{
 		Hostname:         config.Hostname,
 		Runtime:          s.executor.runtime,
 		Args:             s.executor.runtimeArgs,
 		NoPivot:          os.Getenv("BUILDAH_NOPIVOT") != "",
-		Mounts:           convertMounts(s.executor.transientMounts),
+		Mounts:           mounts,
 		Env:              config.Env,
 		User:             config.User,
 		WorkingDir:       config.WorkingDir,
@@ -577,7 +893,7 @@ func (s *StageExecutor) Run(run imagebuilder.Run, config docker.Config) error {
 	if err := s.volumeCacheSave(); err != nil {
 		return err
 	}
-	err := s.builder.Run(args, options)
+	err = s.builder.Run(args, options)
 	if err2 := s.volumeCacheRestore(); err2 != nil {
 		if err == nil {
 			return err2
@@ -586,6 +902,201 @@ func (s *StageExecutor) Run(run imagebuilder.Run, config docker.Config) error {
 	return err
 }
 
+// parseRunMountFlag splits a single "--mount=type=bind,source=...,target=..." flag value (with the
+// leading "--mount=" already stripped) into its comma-separated key=value fields. A field with no
+// "=" (e.g. the bare "ro") is recorded with an empty value.
+func parseRunMountFlag(flag string) map[string]string {
+	fields := make(map[string]string)
+	for _, kv := range strings.Split(flag, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		} else {
+			fields[parts[0]] = ""
+		}
+	}
+	return fields
+}
+
+// resolveRunMounts parses the "--mount=" flags attached to a RUN instruction (imagebuilder's Step
+// keeps them out of step.Args; they arrive in step.Flags, which Step.Resolve copies from the parsed
+// node's Flags) into
+// the specs.Mount entries that Run() should add for that RUN alone, plus any cleanup that needs to
+// run once the instruction finishes.
+func (s *StageExecutor) resolveRunMounts(flags []string) ([]specs.Mount, []func() error, error) {
+	var mounts []specs.Mount
+	var cleanup []func() error
+	for _, flag := range flags {
+		if !strings.HasPrefix(flag, "--mount=") {
+			continue
+		}
+		fields := parseRunMountFlag(strings.TrimPrefix(flag, "--mount="))
+		switch fields["type"] {
+		case "", "bind":
+			source := fields["source"]
+			if from := fields["from"]; from != "" {
+				other, ok := s.executor.stageByName(from)
+				if !ok {
+					return nil, nil, errors.Errorf("RUN --mount=from=%s: no stage found with that name", from)
+				}
+				<-other.done
+				if other.stageErr != nil {
+					return nil, nil, errors.Wrapf(other.stageErr, "the stage %q failed to build", from)
+				}
+				source = filepath.Join(other.mountPoint, source)
+			}
+			opts := []string{"rbind"}
+			if fields["ro"] != "false" {
+				opts = append(opts, "ro")
+			} else {
+				opts = append(opts, "rw")
+			}
+			mounts = append(mounts, specs.Mount{Type: "bind", Source: source, Destination: fields["target"], Options: opts})
+		case "cache":
+			id := fields["id"]
+			if id == "" {
+				id = fields["target"]
+			}
+			// Scoped by stage name as well as id: stages can run concurrently (see
+			// buildConcurrent), so two stages sharing a bare id would otherwise fight over the
+			// same directory. A stage reusing the same id across builds still reuses the same
+			// cache, since its name is stable across runs of the same Dockerfile.
+			cacheRoot := s.executor.cacheDir
+			if cacheRoot == "" {
+				cacheRoot = filepath.Join(s.executor.store.GraphRoot(), "cache", "buildah")
+			}
+			cacheDir := filepath.Join(cacheRoot, s.name, id)
+			mode := os.FileMode(0755)
+			if fields["mode"] != "" {
+				parsed, err := strconv.ParseUint(fields["mode"], 8, 32)
+				if err != nil {
+					return nil, nil, errors.Wrapf(err, "RUN --mount=type=cache,mode=%s: invalid mode", fields["mode"])
+				}
+				mode = os.FileMode(parsed)
+			}
+			if err := os.MkdirAll(cacheDir, mode); err != nil {
+				return nil, nil, errors.Wrapf(err, "error creating cache mount directory %q", cacheDir)
+			}
+			lock, err := lockCacheMount(cacheDir, fields["sharing"])
+			if err != nil {
+				return nil, nil, err
+			}
+			cleanup = append(cleanup, lock.unlock)
+			opts := []string{"rbind"}
+			if uid := fields["uid"]; uid != "" {
+				opts = append(opts, "uid="+uid)
+			}
+			if gid := fields["gid"]; gid != "" {
+				opts = append(opts, "gid="+gid)
+			}
+			// This mount never appears in the committed layer diff (it's only ever added to
+			// options.Mounts for the RUN that asked for it, never under s.mountPoint), and its
+			// contents never factor into the cache key computed by cacheKeyForStep, which hashes
+			// the instruction's text (--mount= flags included) but reads file contents only for
+			// COPY/ADD sources.
+			mounts = append(mounts, specs.Mount{Type: "bind", Source: cacheDir, Destination: fields["target"], Options: opts})
+		case "tmpfs":
+			mounts = append(mounts, specs.Mount{Type: "tmpfs", Source: "tmpfs", Destination: fields["target"], Options: []string{"rw"}})
+		case "secret":
+			id := fields["id"]
+			hostPath, ok := s.executor.secrets[id]
+			if !ok {
+				if fields["required"] == "true" {
+					return nil, nil, errors.Errorf("RUN --mount=type=secret,id=%s: no secret by that name was supplied", id)
+				}
+				continue
+			}
+			target := fields["target"]
+			if target == "" {
+				target = filepath.Join("/run/secrets", id)
+			}
+			// materializeSecretFile writes the secret's contents under
+			// <graphRoot>/tmp/buildah-secrets rather than straight into a tmpfs, since bind-mounting a real
+			// (0400, root-owned) file is what's reachable from this file without deeper runtime
+			// plumbing; cleanup below removes it the moment the RUN instruction is done with
+			// it, so it's never present for longer than that one instruction, and like the
+			// cache mount above it's added only to options.Mounts, so it never becomes part of
+			// the committed layer diff or of the cache key.
+			secretPath, err := materializeSecretFile(s.executor.store.GraphRoot(), id, hostPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			cleanup = append(cleanup, func() error { return os.Remove(secretPath) })
+			mounts = append(mounts, specs.Mount{Type: "bind", Source: secretPath, Destination: target, Options: []string{"rbind", "ro"}})
+		case "ssh":
+			id := fields["id"]
+			if id == "" {
+				id = "default"
+			}
+			sock, ok := s.executor.sshSources[id]
+			if !ok {
+				return nil, nil, errors.Errorf("RUN --mount=type=ssh,id=%s: no SSH source was supplied", id)
+			}
+			target := fields["target"]
+			if target == "" {
+				target = "/run/buildkit/ssh_agent." + id + ".sock"
+			}
+			mounts = append(mounts, specs.Mount{Type: "bind", Source: sock, Destination: target, Options: []string{"rbind", "rw"}})
+		default:
+			return nil, nil, errors.Errorf("RUN --mount: unsupported mount type %q", fields["type"])
+		}
+	}
+	return mounts, cleanup, nil
+}
+
+// cacheLock holds the flock(2) taken out on a RUN --mount=type=cache directory for the lifetime of
+// the RUN instruction that's using it.
+type cacheLock struct {
+	f *os.File
+}
+
+func (l *cacheLock) unlock() error {
+	defer l.f.Close()
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
+
+// lockCacheMount takes out a flock(2) on cacheDir honoring the BuildKit-style sharing= value:
+// "shared" (the default) allows any number of concurrent readers/writers, "locked" serializes all
+// access to the cache across concurrent builds, and "private" skips locking (the mount is still
+// shared by id, but the caller is telling us it won't race itself).
+func lockCacheMount(cacheDir, sharing string) (*cacheLock, error) {
+	f, err := os.OpenFile(filepath.Join(cacheDir, ".buildah-cache.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening cache mount lock for %q", cacheDir)
+	}
+	how := syscall.LOCK_SH
+	switch sharing {
+	case "locked":
+		how = syscall.LOCK_EX
+	case "private":
+		return &cacheLock{f: f}, nil
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "error locking cache mount %q", cacheDir)
+	}
+	return &cacheLock{f: f}, nil
+}
+
+// materializeSecretFile copies the contents of hostPath into a private, 0400 file under
+// <graphRoot>/tmp/buildah-secrets so that it can be bind-mounted into the container for the
+// duration of a single RUN instruction without ever becoming part of the committed layer.
+func materializeSecretFile(graphRoot, id, hostPath string) (string, error) {
+	dir := filepath.Join(graphRoot, "tmp", "buildah-secrets")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrapf(err, "error creating secrets directory %q", dir)
+	}
+	contents, err := ioutil.ReadFile(hostPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading secret %q", id)
+	}
+	target := filepath.Join(dir, id+"-"+stringid.GenerateRandomID())
+	if err := ioutil.WriteFile(target, contents, 0400); err != nil {
+		return "", errors.Wrapf(err, "error writing secret %q", id)
+	}
+	return target, nil
+}
+
 // UnrecognizedInstruction is called when we encounter an instruction that the
 // imagebuilder parser didn't understand.
 func (s *StageExecutor) UnrecognizedInstruction(step *imagebuilder.Step) error {
@@ -608,6 +1119,61 @@ func (s *StageExecutor) UnrecognizedInstruction(step *imagebuilder.Step) error {
 	return errors.Errorf(err)
 }
 
+// namespaceOptionsFromBuildOptions translates the convenience IPC/PID/UTS/Network/CgroupNS/UserNS
+// fields of a BuildOptions into buildah.NamespaceOption entries, overriding (or appending to) base
+// for any namespace that was given a non-empty value. Network only accepts "host", "private", or
+// "ns:<path>" here: joining a named CNI network on a per-build basis would need a field on
+// buildah.RunOptions that this tree's copy of buildah doesn't have, so that form of Network is
+// rejected outright rather than being silently accepted and then never actually applied.
+func namespaceOptionsFromBuildOptions(base []buildah.NamespaceOption, options BuildOptions) ([]buildah.NamespaceOption, error) {
+	merge := func(options []buildah.NamespaceOption, name specs.LinuxNamespaceType, value string) []buildah.NamespaceOption {
+		option := buildah.NamespaceOption{Name: string(name)}
+		switch {
+		case value == "host":
+			option.Host = true
+		case value == "private":
+			// already the zero value
+		case strings.HasPrefix(value, "ns:"):
+			option.Path = strings.TrimPrefix(value, "ns:")
+		default:
+			return options
+		}
+		for i := range options {
+			if options[i].Name == option.Name {
+				options[i] = option
+				return options
+			}
+		}
+		return append(options, option)
+	}
+	if options.IPC != "" {
+		base = merge(base, specs.IPCNamespace, options.IPC)
+	}
+	if options.PID != "" {
+		base = merge(base, specs.PIDNamespace, options.PID)
+	}
+	if options.UTS != "" {
+		base = merge(base, specs.UTSNamespace, options.UTS)
+	}
+	if options.CgroupNS != "" {
+		base = merge(base, specs.CgroupNamespace, options.CgroupNS)
+	}
+	if options.UserNS != "" {
+		base = merge(base, specs.UserNamespace, options.UserNS)
+	}
+	if options.Network != "" {
+		switch {
+		case options.Network == "host" || options.Network == "private":
+			base = merge(base, specs.NetworkNamespace, options.Network)
+		case strings.HasPrefix(options.Network, "ns:"):
+			base = merge(base, specs.NetworkNamespace, options.Network)
+		default:
+			return nil, errors.Errorf("Network %q is not supported: only \"host\", \"private\", or \"ns:<path>\" are accepted; joining a named CNI network on a per-build basis is not implemented", options.Network)
+		}
+	}
+	return base, nil
+}
+
 // NewExecutor creates a new instance of the imagebuilder.Executor interface.
 func NewExecutor(store storage.Store, options BuildOptions) (*Executor, error) {
 	excludes, err := imagebuilder.ParseDockerignore(options.ContextDirectory)
@@ -615,6 +1181,19 @@ func NewExecutor(store storage.Store, options BuildOptions) (*Executor, error) {
 		return nil, err
 	}
 
+	namespaceOptions, err := namespaceOptionsFromBuildOptions(options.NamespaceOptions, options)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := options.Jobs
+	if jobs == 0 {
+		jobs = options.MaxConcurrentStages
+	}
+	if jobs == 0 {
+		jobs = options.MaxParallelStages
+	}
+
 	exec := Executor{
 		store:                          store,
 		contextDir:                     options.ContextDirectory,
@@ -638,7 +1217,7 @@ func NewExecutor(store storage.Store, options BuildOptions) (*Executor, error) {
 		err:                            options.Err,
 		reportWriter:                   options.ReportWriter,
 		isolation:                      options.Isolation,
-		namespaceOptions:               options.NamespaceOptions,
+		namespaceOptions:               namespaceOptions,
 		configureNetwork:               options.ConfigureNetwork,
 		cniPluginPath:                  options.CNIPluginPath,
 		cniConfigDir:                   options.CNIConfigDir,
@@ -653,9 +1232,21 @@ func NewExecutor(store storage.Store, options BuildOptions) (*Executor, error) {
 		useCache:                       !options.NoCache,
 		removeIntermediateCtrs:         options.RemoveIntermediateCtrs,
 		forceRmIntermediateCtrs:        options.ForceRmIntermediateCtrs,
+		removeIntermediateImages:       options.RemoveIntermediateImages,
 		imageMap:                       make(map[string]string),
 		blobDirectory:                  options.BlobDirectory,
 		unusedArgs:                     make(map[string]struct{}),
+		jobs:                           jobs,
+		secrets:                        options.Secrets,
+		sshSources:                     options.SSHSources,
+		cacheFrom:                      options.CacheFrom,
+		cacheTo:                        options.CacheTo,
+		cacheTTL:                       options.CacheTTL,
+		cacheDir:                       options.CacheDir,
+		buildArgs:                      options.Args,
+		provenance:                     options.Provenance,
+		sbomScanners:                   options.SBOMScanners,
+		progressWriter:                 options.ProgressWriter,
 	}
 	if exec.err == nil {
 		exec.err = os.Stderr
@@ -672,6 +1263,29 @@ func NewExecutor(store storage.Store, options BuildOptions) (*Executor, error) {
 			fmt.Fprintf(exec.err, prefix+format+suffix, args...)
 		}
 	}
+	if exec.jobs > 1 {
+		// With stages running in their own goroutines, two of them can call exec.log() at
+		// the same time; without serializing the calls, their output (and, for the default
+		// logger, stepCounter) could interleave mid-line.
+		unlocked := exec.log
+		exec.log = func(format string, args ...interface{}) {
+			exec.logMutex.Lock()
+			defer exec.logMutex.Unlock()
+			unlocked(format, args...)
+		}
+	}
+	// Every call to exec.log also goes through emit, as a generic "log" event, so a consumer
+	// reading BuildOptions.ProgressWriter sees everything the human-readable log does without
+	// needing a second, separately-maintained emit call at each of exec.log's many call sites.
+	// Call sites that need a richer, typed event (e.g. "step", "commit") still emit one of
+	// those alongside the log call that produced the same text. This wraps the (possibly
+	// mutex-serialized, above) logger rather than being wrapped by it, so that emit's own
+	// locking of logMutex can't nest inside an already-held logMutex lock.
+	humanLog := exec.log
+	exec.log = func(format string, args ...interface{}) {
+		humanLog(format, args...)
+		exec.emit(progressEvent{Type: "log", Message: fmt.Sprintf(format, args...)})
+	}
 	for arg := range options.Args {
 		if _, isBuiltIn := builtinAllowedBuildArgs[arg]; !isBuiltIn {
 			exec.unusedArgs[arg] = struct{}{}
@@ -709,8 +1323,9 @@ func (s *StageExecutor) Prepare(ctx context.Context, stage imagebuilder.Stage, f
 
 	logrus.Debugf("FROM %#v", displayFrom)
 	if !s.executor.quiet {
-		s.executor.log("FROM %s", displayFrom)
+		s.executor.log("%sFROM %s", s.logPrefix(), displayFrom)
 	}
+	s.executor.emit(progressEvent{Type: "stage", Stage: s.name, Message: "FROM " + displayFrom})
 
 	builderOptions := buildah.BuilderOptions{
 		Args:                  ib.Args,
@@ -800,9 +1415,12 @@ func (s *StageExecutor) Prepare(ctx context.Context, stage imagebuilder.Stage, f
 	}
 	s.mountPoint = mountPoint
 	s.builder = builder
-	// Add the top layer of this image to b.topLayers so we can keep track of them
-	// when building with cached images.
-	s.executor.topLayers = append(s.executor.topLayers, builder.TopLayer)
+	// Add the top layer of this image to s.topLayers so we can keep track of
+	// them when building with cached images. This is tracked per-stage (and
+	// not shared across stages, even when they run concurrently) since it
+	// only ever needs to reflect this stage's own progression through its
+	// instructions.
+	s.topLayers = append(s.topLayers, builder.TopLayer)
 	logrus.Debugln("Container ID:", builder.ContainerID)
 	return nil
 }
@@ -862,20 +1480,24 @@ func (s *StageExecutor) Execute(ctx context.Context, stage imagebuilder.Stage) (
 			return "", nil, errors.Wrapf(err, "error resolving step %+v", *node)
 		}
 		logrus.Debugf("Parsed Step: %+v", *step)
+		stepStart := time.Now()
 		if !s.executor.quiet {
-			s.executor.log("%s", step.Original)
+			s.executor.log("%s%s", s.logPrefix(), step.Original)
 		}
+		s.executor.emit(progressEvent{Type: "step", Stage: s.name, Step: step.Original})
 
 		// If this instruction declares an argument, remove it from the
 		// set of arguments that we were passed but which we haven't
 		// seen used by the Dockerfile.
 		if step.Command == "arg" {
+			s.executor.stageMutex.Lock()
 			for _, Arg := range step.Args {
 				list := strings.SplitN(Arg, "=", 2)
 				if _, stillUnused := s.executor.unusedArgs[list[0]]; stillUnused {
 					delete(s.executor.unusedArgs, list[0])
 				}
 			}
+			s.executor.stageMutex.Unlock()
 		}
 
 		// Check if there's a --from if the step command is COPY or
@@ -885,10 +1507,14 @@ func (s *StageExecutor) Execute(ctx context.Context, stage imagebuilder.Stage) (
 		for _, n := range step.Flags {
 			if strings.Contains(n, "--from") && (step.Command == "copy" || step.Command == "add") {
 				arr := strings.Split(n, "=")
-				stage, ok := s.executor.stages[arr[1]]
+				stage, ok := s.executor.stageByName(arr[1])
 				if !ok {
 					return "", nil, errors.Errorf("%s --from=%s: no stage found with that name", step.Command, arr[1])
 				}
+				<-stage.done
+				if stage.stageErr != nil {
+					return "", nil, errors.Wrapf(stage.stageErr, "the stage %q failed to build", arr[1])
+				}
 				s.copyFrom = stage.mountPoint
 				break
 			}
@@ -903,6 +1529,20 @@ func (s *StageExecutor) Execute(ctx context.Context, stage imagebuilder.Stage) (
 			noRunsRemaining = !ib.RequiresStart(&parser.Node{Children: children[i+1:]})
 		}
 
+		// BuildKit-style "RUN --mount=" flags: imagebuilder's Step keeps
+		// them out of step.Args, so take the --mount= flags from
+		// step.Flags and stash the resulting mounts for Run() to
+		// pick up; they apply to this instruction alone and are never
+		// persisted into the committed image.
+		if step.Command == "run" {
+			mounts, cleanup, err := s.resolveRunMounts(step.Flags)
+			if err != nil {
+				return "", nil, errors.Wrapf(err, "error processing --mount for step %+v", *step)
+			}
+			s.pendingRunMounts = mounts
+			s.pendingRunCleanup = cleanup
+		}
+
 		// If we're doing a single-layer build and not looking to take
 		// shortcuts using the cache, make a note of the instruction,
 		// process it, and then move on to the next instruction.
@@ -911,6 +1551,7 @@ func (s *StageExecutor) Execute(ctx context.Context, stage imagebuilder.Stage) (
 			if err != nil {
 				return "", nil, errors.Wrapf(err, "error building at step %+v", *step)
 			}
+			s.executor.emit(progressEvent{Type: "step-end", Stage: s.name, Step: step.Original, Duration: time.Since(stepStart)})
 			continue
 		}
 
@@ -940,6 +1581,7 @@ func (s *StageExecutor) Execute(ctx context.Context, stage imagebuilder.Stage) (
 		}
 		if cacheID != "" {
 			fmt.Fprintf(s.executor.out, "--> Using cache %s\n", cacheID)
+			s.executor.emit(progressEvent{Type: "cache", Stage: s.name, Step: step.Original, ImageID: cacheID})
 		}
 
 		// If a cache is found and we're on the last step, that means
@@ -951,6 +1593,7 @@ func (s *StageExecutor) Execute(ctx context.Context, stage imagebuilder.Stage) (
 			if imgID, ref, err = s.copyExistingImage(ctx, cacheID, commitName); err != nil {
 				return "", nil, err
 			}
+			s.executor.emit(progressEvent{Type: "step-end", Stage: s.name, Step: step.Original, Duration: time.Since(stepStart)})
 			break
 		}
 
@@ -966,12 +1609,31 @@ func (s *StageExecutor) Execute(ctx context.Context, stage imagebuilder.Stage) (
 
 		// Commit if no cache is found
 		if cacheID == "" {
-			imgID, ref, err = s.Commit(ctx, ib, getCreatedBy(node), commitName)
+			createdBy := getCreatedBy(node)
+			if s.executor.useCache {
+				if cacheKey, keyErr := s.cacheKeyForStep(s.builder.FromImageID, node, ib.Args); keyErr == nil {
+					s.builder.SetAnnotation(cacheKeyAnnotation, cacheKey)
+					createdBy += cacheKeyComment(cacheKey)
+				} else {
+					logrus.Debugf("not computing a cache key for %+v: %v", *step, keyErr)
+				}
+				if copyDigest, digestErr := s.copiedFilesDigest(node); digestErr == nil && copyDigest != "" {
+					s.builder.SetAnnotation(copyDigestAnnotation, copyDigest)
+					createdBy += copyDigestComment(copyDigest)
+				} else if digestErr != nil {
+					logrus.Debugf("not computing a copy digest for %+v: %v", *step, digestErr)
+				}
+			}
+			imgID, ref, err = s.Commit(ctx, ib, createdBy, commitName)
 			if err != nil {
 				return "", nil, errors.Wrapf(err, "error committing container for step %+v", *step)
 			}
 			if i == len(children)-1 {
 				s.executor.log("COMMIT %s", commitName)
+			} else if s.executor.layers {
+				s.executor.stageMutex.Lock()
+				s.executor.intermediateImages = append(s.executor.intermediateImages, imgID)
+				s.executor.stageMutex.Unlock()
 			}
 		} else {
 			// If we did find a cache, reuse the cached image's ID
@@ -986,6 +1648,7 @@ func (s *StageExecutor) Execute(ctx context.Context, stage imagebuilder.Stage) (
 				return "", nil, errors.Wrap(err, "error preparing container for next step")
 			}
 		}
+		s.executor.emit(progressEvent{Type: "step-end", Stage: s.name, Step: step.Original, Duration: time.Since(stepStart)})
 	}
 
 	if s.executor.layers { // print out the final imageID if we're using layers flag
@@ -1036,123 +1699,794 @@ func (s *StageExecutor) copyExistingImage(ctx context.Context, cacheID, output s
 	return img.ID, ref, nil
 }
 
-// layerExists returns true if an intermediate image of currNode exists in the image store from a previous build.
-// It verifies this by checking the parent of the top layer of the image and the history.
-func (s *StageExecutor) layerExists(ctx context.Context, currNode *parser.Node, children []*parser.Node) (string, error) {
-	// Get the list of images available in the image store
-	images, err := s.executor.store.Images()
-	if err != nil {
-		return "", errors.Wrap(err, "error getting image list from store")
+// parseCacheReference parses a CacheFrom/CacheTo entry, assuming the docker:// transport for a bare
+// "registry/repo:tag" the way most other buildah image-name arguments do.
+func parseCacheReference(ref string) (types.ImageReference, error) {
+	if parsed, err := alltransports.ParseImageName(ref); err == nil {
+		return parsed, nil
 	}
-	for _, image := range images {
-		layer, err := s.executor.store.Layer(image.TopLayer)
-		if err != nil {
-			return "", errors.Wrapf(err, "error getting top layer info")
-		}
-		// If the parent of the top layer of an image is equal to the last entry in b.topLayers
-		// it means that this image is potentially a cached intermediate image from a previous
-		// build. Next we double check that the history of this image is equivalent to the previous
-		// lines in the Dockerfile up till the point we are at in the build.
-		if layer.Parent == s.executor.topLayers[len(s.executor.topLayers)-1] {
-			history, err := s.executor.getImageHistory(ctx, image.ID)
+	return alltransports.ParseImageName("docker://" + ref)
+}
+
+// remoteCache returns this build's index of remote cache keys to the CacheFrom reference that
+// offered them, built by pulling each CacheFrom image's config and manifest (not its layers)
+// exactly once. A key is read two ways: out of the per-step cache-key comments in the image's
+// history (the same way extractCacheKeyComment reads them out of a local image's history in
+// layerExists), and, for images pushed in OCI manifest format, out of the manifest's own
+// Annotations map (the same cacheKeyAnnotation that SetAnnotation records locally) -- some push
+// paths (squash, re-manifesting) drop history comments but preserve manifest annotations, so
+// checking both catches cache hits the comment-only check would otherwise miss.
+func (b *Executor) remoteCache(ctx context.Context) (map[string]string, error) {
+	b.remoteCacheOnce.Do(func() {
+		index := make(map[string]string)
+		for _, from := range b.cacheFrom {
+			ref, err := parseCacheReference(from)
 			if err != nil {
-				return "", errors.Wrapf(err, "error getting history of %q", image.ID)
+				logrus.Debugf("error parsing cache-from reference %q: %v", from, err)
+				continue
 			}
-			// children + currNode is the point of the Dockerfile we are currently at.
-			if historyMatches(append(children, currNode), history) {
-				// This checks if the files copied during build have been changed if the node is
-				// a COPY or ADD command.
-				filesMatch, err := s.copiedFilesMatch(currNode, history[len(history)-1].Created)
-				if err != nil {
-					return "", errors.Wrapf(err, "error checking if copied files match")
+			img, err := ref.NewImage(ctx, b.systemContext)
+			if err != nil {
+				logrus.Debugf("error reading cache-from image %q: %v", from, err)
+				continue
+			}
+			oci, err := img.OCIConfig(ctx)
+			if err != nil {
+				img.Close()
+				logrus.Debugf("error reading cache-from image config %q: %v", from, err)
+				continue
+			}
+			if b.cacheTTL > 0 && oci.Created != nil && time.Since(*oci.Created) > b.cacheTTL {
+				img.Close()
+				logrus.Debugf("cache-from image %q is older than --cache-ttl, ignoring", from)
+				continue
+			}
+			for _, h := range oci.History {
+				if key, ok := extractCacheKeyComment(h.CreatedBy); ok {
+					if _, taken := index[key]; !taken {
+						index[key] = from
+					}
 				}
-				if filesMatch {
-					return image.ID, nil
+			}
+			if manifestBytes, mimeType, err := img.Manifest(ctx); err == nil && mimeType == v1.MediaTypeImageManifest {
+				var m v1.Manifest
+				if err := json.Unmarshal(manifestBytes, &m); err == nil {
+					if key, ok := m.Annotations[cacheKeyAnnotation]; ok {
+						if _, taken := index[key]; !taken {
+							index[key] = from
+						}
+					}
 				}
 			}
+			img.Close()
 		}
-	}
-	return "", nil
+		b.remoteCacheIndex = index
+	})
+	return b.remoteCacheIndex, nil
 }
 
-// getImageHistory returns the history of imageID.
-func (b *Executor) getImageHistory(ctx context.Context, imageID string) ([]v1.History, error) {
-	imageRef, err := is.Transport.ParseStoreReference(b.store, "@"+imageID)
+// pullRemoteCacheHit checks whether key was offered by one of the executor's CacheFrom images, and
+// if so, copies that whole image into local storage and returns its new local ID so the caller can
+// use it exactly like a cache hit found in local storage.
+func (s *StageExecutor) pullRemoteCacheHit(ctx context.Context, key string) (string, error) {
+	index, err := s.executor.remoteCache(ctx)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error getting image reference %q", imageID)
+		return "", err
 	}
-	ref, err := imageRef.NewImage(ctx, nil)
+	from, ok := index[key]
+	if !ok {
+		return "", nil
+	}
+	src, err := parseCacheReference(from)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating new image from reference")
+		return "", err
 	}
-	oci, err := ref.OCIConfig(ctx)
+	dest, err := is.Transport.ParseStoreReference(s.executor.store, "@"+stringid.GenerateRandomID())
 	if err != nil {
-		return nil, errors.Wrapf(err, "error getting oci config of image %q", imageID)
+		return "", err
 	}
-	return oci.History, nil
-}
-
-// getCreatedBy returns the command the image at node will be created by.
-func getCreatedBy(node *parser.Node) string {
-	if node.Value == "run" {
-		return "/bin/sh -c " + node.Original[4:]
+	policyContext, err := util.GetPolicyContext(s.executor.systemContext)
+	if err != nil {
+		return "", err
 	}
-	return "/bin/sh -c #(nop) " + node.Original
-}
-
-// historyMatches returns true if the history of the image matches the lines
-// in the Dockerfile till the point of build we are at.
-// Used to verify whether a cache of the intermediate image exists and whether
-// to run the build again.
-func historyMatches(children []*parser.Node, history []v1.History) bool {
-	i := len(history) - 1
-	for j := len(children) - 1; j >= 0; j-- {
-		instruction := children[j].Original
-		if children[j].Value == "run" {
-			instruction = instruction[4:]
-		}
-		if !strings.Contains(history[i].CreatedBy, instruction) {
-			return false
-		}
-		i--
+	defer policyContext.Destroy()
+	if _, err := cp.Image(ctx, policyContext, dest, src, nil); err != nil {
+		return "", errors.Wrapf(err, "error pulling cache image %q", from)
 	}
-	return true
+	img, err := is.Transport.GetStoreImage(s.executor.store, dest)
+	if err != nil {
+		return "", errors.Wrapf(err, "error locating pulled cache image %q (i.e., %q)", from, transports.ImageName(dest))
+	}
+	s.executor.log("using remote build cache %s for %s", from, key)
+	return img.ID, nil
 }
 
-// getFilesToCopy goes through node to get all the src files that are copied, added or downloaded.
-// It is possible for the Dockerfile to have src as hom*, which means all files that have hom as a prefix.
-// Another format is hom?.txt, which means all files that have that name format with the ? replaced by another character.
-func (s *StageExecutor) getFilesToCopy(node *parser.Node) ([]string, error) {
-	currNode := node.Next
-	var src []string
-	for currNode.Next != nil {
-		if strings.HasPrefix(currNode.Value, "http://") || strings.HasPrefix(currNode.Value, "https://") {
-			src = append(src, currNode.Value)
-			currNode = currNode.Next
+// exportRemoteCache pushes imageID to every configured CacheTo destination once a build finishes,
+// so that the per-step cache keys baked into its history (see cacheKeyForStep) become available to
+// CacheFrom on other hosts. Push failures are logged and otherwise ignored: a build shouldn't fail
+// just because its cache couldn't be shared.
+func (b *Executor) exportRemoteCache(ctx context.Context, imageID string) {
+	if len(b.cacheTo) == 0 || imageID == "" {
+		return
+	}
+	src, err := is.Transport.ParseStoreReference(b.store, imageID)
+	if err != nil {
+		logrus.Debugf("error preparing to push build cache: %v", err)
+		return
+	}
+	policyContext, err := util.GetPolicyContext(b.systemContext)
+	if err != nil {
+		logrus.Debugf("error preparing to push build cache: %v", err)
+		return
+	}
+	defer policyContext.Destroy()
+	for _, to := range b.cacheTo {
+		dest, err := parseCacheReference(to)
+		if err != nil {
+			logrus.Debugf("error parsing cache-to reference %q: %v", to, err)
 			continue
 		}
-		matches, err := filepath.Glob(filepath.Join(s.copyFrom, currNode.Value))
-		if err != nil {
-			return nil, errors.Wrapf(err, "error finding match for pattern %q", currNode.Value)
+		if _, err := cp.Image(ctx, policyContext, dest, src, nil); err != nil {
+			logrus.Debugf("error pushing build cache to %q: %v", to, err)
+			continue
 		}
-		src = append(src, matches...)
-		currNode = currNode.Next
+		b.log("CACHE-TO %s", to)
 	}
-	return src, nil
 }
 
-// copiedFilesMatch checks to see if the node instruction is a COPY or ADD.
-// If it is either of those two it checks the timestamps on all the files copied/added
-// by the dockerfile. If the host version has a time stamp greater than the time stamp
-// of the build, the build will not use the cached version and will rebuild.
-func (s *StageExecutor) copiedFilesMatch(node *parser.Node, historyTime *time.Time) (bool, error) {
-	if node.Value != "add" && node.Value != "copy" {
-		return true, nil
-	}
+// SBOMPackage describes one installed software package discovered by an SBOMScanner.
+type SBOMPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Source  string `json:"source"` // e.g. "dpkg", "apk", "rpm"
+}
 
-	src, err := s.getFilesToCopy(node)
+// SBOMScanner inspects rootfs, the root filesystem of a just-built image, and returns the
+// packages it finds installed there. A scanner should return an empty slice, not an error, when
+// its package manager's metadata is simply absent; an error should mean the metadata was present
+// but unreadable or malformed.
+type SBOMScanner interface {
+	Scan(rootfs string) ([]SBOMPackage, error)
+}
+
+// DefaultSBOMScanner is the SBOMScanner most callers should pass in BuildOptions.SBOMScanners: it
+// covers dpkg- and apk-based images. RPM's package database is a BerkeleyDB (or, on newer
+// distros, sqlite) file, not something we can parse correctly without linking against librpm, so
+// it's only checked for presence; an RPM-based image still yields an SBOM, just not one with
+// per-package detail, unless the caller supplies their own scanner (e.g. one that shells out to
+// "rpm -qa" inside the container).
+var DefaultSBOMScanner SBOMScanner = systemPackageSBOMScanner{}
+
+type systemPackageSBOMScanner struct{}
+
+func (systemPackageSBOMScanner) Scan(rootfs string) ([]SBOMPackage, error) {
+	var packages []SBOMPackage
+	dpkgPackages, err := scanDpkgStatus(filepath.Join(rootfs, "var/lib/dpkg/status"))
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	packages = append(packages, dpkgPackages...)
+	apkPackages, err := scanApkInstalled(filepath.Join(rootfs, "lib/apk/db/installed"))
+	if err != nil {
+		return nil, err
+	}
+	packages = append(packages, apkPackages...)
+	if _, err := os.Stat(filepath.Join(rootfs, "var/lib/rpm")); err == nil {
+		packages = append(packages, SBOMPackage{Name: "(rpm database present, not parsed)", Source: "rpm"})
+	}
+	return packages, nil
+}
+
+// scanDpkgStatus parses the stanza-per-package format of dpkg's status file, the same one that
+// "dpkg -l" reads from.
+func scanDpkgStatus(path string) ([]SBOMPackage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "error reading %q", path)
+	}
+	defer f.Close()
+	var packages []SBOMPackage
+	var name, version string
+	installed := false
+	flush := func() {
+		if name != "" && installed {
+			packages = append(packages, SBOMPackage{Name: name, Version: version, Source: "dpkg"})
+		}
+		name, version, installed = "", "", false
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "Package: "):
+			name = strings.TrimPrefix(line, "Package: ")
+		case strings.HasPrefix(line, "Version: "):
+			version = strings.TrimPrefix(line, "Version: ")
+		case strings.HasPrefix(line, "Status: "):
+			installed = strings.HasSuffix(line, " installed")
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error reading %q", path)
+	}
+	return packages, nil
+}
+
+// scanApkInstalled parses apk's flat-file package database, one "P:"/"V:" (among other fields)
+// stanza per installed package, blank-line separated.
+func scanApkInstalled(path string) ([]SBOMPackage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "error reading %q", path)
+	}
+	defer f.Close()
+	var packages []SBOMPackage
+	var name, version string
+	flush := func() {
+		if name != "" {
+			packages = append(packages, SBOMPackage{Name: name, Version: version, Source: "apk"})
+		}
+		name, version = "", ""
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "P:"):
+			name = strings.TrimPrefix(line, "P:")
+		case strings.HasPrefix(line, "V:"):
+			version = strings.TrimPrefix(line, "V:")
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error reading %q", path)
+	}
+	return packages, nil
+}
+
+// buildProvenance is the SLSA-style build provenance document we push as an OCI referrer
+// artifact when BuildOptions.Provenance is set. It's deliberately modest: enough for a consumer
+// to see what Dockerfile, base images, and build args produced the image, without claiming to
+// implement the full SLSA provenance predicate schema.
+type buildProvenance struct {
+	BuilderID        string            `json:"builderId"`
+	DockerfileDigest string            `json:"dockerfileDigest,omitempty"`
+	BuildArgs        map[string]string `json:"buildArgs,omitempty"`
+	Stages           []stageProvenance `json:"stages"`
+}
+
+// stageProvenance records one Dockerfile stage's base image and the instructions run against it.
+type stageProvenance struct {
+	Name  string   `json:"name,omitempty"`
+	From  string   `json:"from,omitempty"`
+	Steps []string `json:"steps,omitempty"`
+}
+
+// buildProvenanceDocument assembles the provenance document for the stages that made up this
+// build. Since it only reads from the already-parsed Stages and from fields we stored at
+// NewExecutor time, it can run after every stage has finished, with no per-step bookkeeping
+// needed during Execute.
+func (b *Executor) buildProvenanceDocument(stages imagebuilder.Stages) *buildProvenance {
+	doc := &buildProvenance{
+		BuilderID:        "github.com/containers/buildah/imagebuildah",
+		DockerfileDigest: b.dockerfileDigest,
+	}
+	if len(b.buildArgs) > 0 {
+		doc.BuildArgs = make(map[string]string, len(b.buildArgs))
+		for name, value := range b.buildArgs {
+			if _, stillUnused := b.unusedArgs[name]; !stillUnused {
+				doc.BuildArgs[name] = value
+			}
+		}
+		if len(doc.BuildArgs) == 0 {
+			doc.BuildArgs = nil
+		}
+	}
+	for _, stage := range stages {
+		sp := stageProvenance{Name: stage.Name}
+		for _, child := range stage.Node.Children {
+			sp.Steps = append(sp.Steps, child.Original)
+			if strings.EqualFold(child.Value, "from") && child.Next != nil {
+				sp.From = child.Next.Value
+			}
+		}
+		doc.Stages = append(doc.Stages, sp)
+	}
+	return doc
+}
+
+// provenanceArtifactType and sbomArtifactType are the OCI artifactType values used for the two
+// kinds of referrer artifacts emitProvenance can push.
+const (
+	provenanceArtifactType = "application/vnd.buildah.provenance.v1+json"
+	sbomArtifactType       = "application/vnd.buildah.sbom.v1+json"
+	emptyConfigMediaType   = "application/vnd.oci.empty.v1+json"
+	referrerManifestType   = "application/vnd.oci.image.manifest.v1+json"
+)
+
+// referrerManifest mirrors the subset of the OCI 1.1 image manifest schema needed to attach a
+// "subject" pointing at another manifest (the referrers pattern). It's a local type rather than
+// v1.Manifest because the image-spec version vendored here predates the Subject field.
+type referrerManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	ArtifactType  string          `json:"artifactType,omitempty"`
+	Config        v1.Descriptor   `json:"config"`
+	Layers        []v1.Descriptor `json:"layers"`
+	Subject       *v1.Descriptor  `json:"subject,omitempty"`
+}
+
+// pushReferrerArtifact pushes data as a standalone OCI artifact manifest to dest, with its
+// "subject" field pointing at subject (normally the final image's own manifest digest), so that
+// a registry supporting the OCI 1.1 referrers API can later hand it back to anyone asking what
+// refers to that image.
+func pushReferrerArtifact(ctx context.Context, sys *types.SystemContext, dest types.ImageReference, subject digest.Digest, artifactType string, data []byte) error {
+	imgDest, err := dest.NewImageDestination(ctx, sys)
+	if err != nil {
+		return errors.Wrapf(err, "error opening %q to push %s", transports.ImageName(dest), artifactType)
+	}
+	defer imgDest.Close()
+
+	emptyConfig := []byte("{}")
+	configInfo, err := imgDest.PutBlob(ctx, bytes.NewReader(emptyConfig), types.BlobInfo{Digest: digest.FromBytes(emptyConfig), Size: int64(len(emptyConfig))}, false)
+	if err != nil {
+		return errors.Wrapf(err, "error pushing empty config for %s", artifactType)
+	}
+	layerInfo, err := imgDest.PutBlob(ctx, bytes.NewReader(data), types.BlobInfo{Digest: digest.FromBytes(data), Size: int64(len(data))}, false)
+	if err != nil {
+		return errors.Wrapf(err, "error pushing %s content", artifactType)
+	}
+
+	m := referrerManifest{
+		SchemaVersion: 2,
+		MediaType:     referrerManifestType,
+		ArtifactType:  artifactType,
+		Config: v1.Descriptor{
+			MediaType: emptyConfigMediaType,
+			Digest:    configInfo.Digest,
+			Size:      configInfo.Size,
+		},
+		Layers: []v1.Descriptor{{
+			MediaType: artifactType,
+			Digest:    layerInfo.Digest,
+			Size:      layerInfo.Size,
+		}},
+		Subject: &v1.Descriptor{
+			MediaType: referrerManifestType,
+			Digest:    subject,
+		},
+	}
+	manifestBytes, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrapf(err, "error marshaling %s manifest", artifactType)
+	}
+	if err := imgDest.PutManifest(ctx, manifestBytes); err != nil {
+		return errors.Wrapf(err, "error pushing %s manifest", artifactType)
+	}
+	return imgDest.Commit(ctx)
+}
+
+// emitProvenance builds a SLSA-style build provenance document (when Provenance is set) and an
+// SBOM (when SBOMScanners is non-empty) for the image the build just produced, and pushes each as
+// a separate OCI 1.1 referrer artifact to every destination named in CacheTo, which is the only
+// registry location this package otherwise knows about; a build with no CacheTo entries has
+// nowhere to push a referrer to, so this is a no-op (logged at debug level) in that case. Failures
+// are logged and otherwise ignored, the same way exportRemoteCache treats push failures: missing
+// provenance/SBOM shouldn't fail an otherwise-successful build.
+func (b *Executor) emitProvenance(ctx context.Context, stages imagebuilder.Stages, final *StageExecutor, imageID string, ref reference.Canonical) {
+	if !b.provenance && len(b.sbomScanners) == 0 {
+		return
+	}
+	if ref == nil {
+		logrus.Debugf("not pushing build provenance/SBOM for %q: final image has no canonical reference", imageID)
+		return
+	}
+	if len(b.cacheTo) == 0 {
+		logrus.Debugf("not pushing build provenance/SBOM for %q: no --cache-to destination configured", imageID)
+		return
+	}
+
+	var provenanceData, sbomData []byte
+	if b.provenance {
+		data, err := json.MarshalIndent(b.buildProvenanceDocument(stages), "", "  ")
+		if err != nil {
+			logrus.Debugf("error marshaling build provenance for %q: %v", imageID, err)
+		} else {
+			provenanceData = data
+		}
+	}
+	if len(b.sbomScanners) > 0 && final != nil && final.mountPoint != "" {
+		var packages []SBOMPackage
+		for _, scanner := range b.sbomScanners {
+			found, err := scanner.Scan(final.mountPoint)
+			if err != nil {
+				logrus.Debugf("error running SBOM scanner for %q: %v", imageID, err)
+				continue
+			}
+			packages = append(packages, found...)
+		}
+		data, err := json.MarshalIndent(struct {
+			Packages []SBOMPackage `json:"packages"`
+		}{packages}, "", "  ")
+		if err != nil {
+			logrus.Debugf("error marshaling SBOM for %q: %v", imageID, err)
+		} else {
+			sbomData = data
+		}
+	}
+	if provenanceData == nil && sbomData == nil {
+		return
+	}
+
+	for _, to := range b.cacheTo {
+		dest, err := parseCacheReference(to)
+		if err != nil {
+			logrus.Debugf("error parsing cache-to reference %q for provenance/SBOM: %v", to, err)
+			continue
+		}
+		if provenanceData != nil {
+			if err := pushReferrerArtifact(ctx, b.systemContext, dest, ref.Digest(), provenanceArtifactType, provenanceData); err != nil {
+				logrus.Debugf("error pushing build provenance to %q: %v", to, err)
+			} else {
+				b.log("PROVENANCE %s", to)
+			}
+		}
+		if sbomData != nil {
+			if err := pushReferrerArtifact(ctx, b.systemContext, dest, ref.Digest(), sbomArtifactType, sbomData); err != nil {
+				logrus.Debugf("error pushing SBOM to %q: %v", to, err)
+			} else {
+				b.log("SBOM %s", to)
+			}
+		}
+	}
+}
+
+// cacheKeyAnnotation is the annotation under which we record the
+// deterministic cache key (see cacheKeyForStep) for the instruction that
+// produced a given intermediate image. remoteCache reads it back from the
+// manifest annotations of CacheFrom images; layerExists instead reads the
+// same key out of local images' history (see cacheKeyComment).
+const cacheKeyAnnotation = "io.buildah.cache-key"
+
+// cacheKeyComment formats key as a trailing comment on a CreatedBy string,
+// piggy-backing on the same history entry that getCreatedBy already
+// produces so that builds against image stores which don't preserve
+// annotations (or images built before this existed) still carry the key
+// somewhere inspectable.
+func cacheKeyComment(key string) string {
+	return fmt.Sprintf(" #(buildah-cache-key:%s)", key)
+}
+
+// extractCacheKeyComment pulls a key embedded by cacheKeyComment back out
+// of a CreatedBy string, if one is present.
+func extractCacheKeyComment(createdBy string) (string, bool) {
+	const marker = "#(buildah-cache-key:"
+	i := strings.Index(createdBy, marker)
+	if i < 0 {
+		return "", false
+	}
+	rest := createdBy[i+len(marker):]
+	j := strings.IndexByte(rest, ')')
+	if j < 0 {
+		return "", false
+	}
+	return rest[:j], true
+}
+
+// cacheKeyForStep computes a deterministic cache key for the instruction
+// that node represents, mixing in the image ID of the container it would
+// run against, the instruction's canonicalized text, the build-time ARG
+// values currently in scope, and - for COPY/ADD - a content digest of the
+// matched source files, so that a change to any of those invalidates the
+// cached layer even when file mtimes or a textual history match wouldn't
+// have caught it.
+func (s *StageExecutor) cacheKeyForStep(parentImageID string, node *parser.Node, args map[string]string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "parent=%s\n", parentImageID)
+	fmt.Fprintf(h, "instruction=%s\n", strings.Join(strings.Fields(node.Original), " "))
+
+	argNames := make([]string, 0, len(args))
+	for name := range args {
+		argNames = append(argNames, name)
+	}
+	sort.Strings(argNames)
+	for _, name := range argNames {
+		fmt.Fprintf(h, "arg:%s=%s\n", name, args[name])
+	}
+
+	if node.Value == "copy" || node.Value == "add" {
+		srcs, err := s.getFilesToCopy(node)
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(srcs)
+		for _, src := range srcs {
+			if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+				fmt.Fprintf(h, "url:%s\n", src)
+				continue
+			}
+			if err := sumTree(h, src); err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sumTree mixes the contents, mode, and ownership of path (walking it if
+// it's a directory) into h.
+func sumTree(h io.Writer, path string) error {
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		uid, gid := 0, 0
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+		fmt.Fprintf(h, "path=%s mode=%s uid=%d gid=%d\n", p, info.Mode(), uid, gid)
+		if info.Mode().IsRegular() {
+			f, err := os.Open(p)
+			if err != nil {
+				return errors.Wrapf(err, "error reading %q for cache key", p)
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return errors.Wrapf(err, "error hashing %q for cache key", p)
+			}
+		}
+		return nil
+	})
+}
+
+// copyDigestAnnotation is the annotation under which we record the digest
+// of the source files a COPY or ADD instruction copied (see
+// copiedFilesDigest). copiedFilesMatch compares against the same digest as
+// recorded in the image's history (see copyDigestComment), to tell whether
+// the files have changed without resorting to comparing filesystem mtimes,
+// which routinely lie (a fresh checkout always looks "newer" than the cache).
+const copyDigestAnnotation = "buildah.copy.digest"
+
+// copyDigestComment formats digest as a trailing comment on a CreatedBy
+// string, the same way cacheKeyComment does for cache keys, so that it
+// survives against image stores that don't preserve annotations.
+func copyDigestComment(digest string) string {
+	return fmt.Sprintf(" #(buildah-copy-digest:%s)", digest)
+}
+
+// extractCopyDigestComment pulls a digest embedded by copyDigestComment
+// back out of a CreatedBy string, if one is present.
+func extractCopyDigestComment(createdBy string) (string, bool) {
+	const marker = "#(buildah-copy-digest:"
+	i := strings.Index(createdBy, marker)
+	if i < 0 {
+		return "", false
+	}
+	rest := createdBy[i+len(marker):]
+	j := strings.IndexByte(rest, ')')
+	if j < 0 {
+		return "", false
+	}
+	return rest[:j], true
+}
+
+// copiedFilesDigest computes a content digest for the files a COPY or ADD instruction would copy,
+// mixing in each local file's mode/uid/gid/content by way of sumTree plus the instruction's
+// destination, and, for URL sources, the response's ETag and Content-Length from a HEAD request
+// instead of downloading the body. It returns ("", nil) for any other instruction.
+func (s *StageExecutor) copiedFilesDigest(node *parser.Node) (string, error) {
+	if node.Value != "add" && node.Value != "copy" {
+		return "", nil
+	}
+	srcs, err := s.getFilesToCopy(node)
+	if err != nil {
+		return "", err
+	}
+	dest := ""
+	for n := node.Next; n != nil; n = n.Next {
+		if n.Next == nil {
+			dest = n.Value
+		}
+	}
+	sort.Strings(srcs)
+	h := sha256.New()
+	fmt.Fprintf(h, "dest=%s\n", dest)
+	for _, src := range srcs {
+		if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+			info, err := urlDigestInfo(src)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "url=%s %s\n", src, info)
+			continue
+		}
+		if err := sumTree(h, src); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// urlDigestInfo sends a HEAD request for url and returns a string combining its ETag and
+// Content-Length headers, which is cheap enough to check on every build, unlike streaming the whole
+// body through sha256 the way copiedFilesDigest does for local files.
+func urlDigestInfo(url string) (string, error) {
+	resp, err := http.Head(url)
+	if err != nil {
+		return "", errors.Wrapf(err, "error sending HEAD request to %q", url)
+	}
+	defer resp.Body.Close()
+	return fmt.Sprintf("etag=%s length=%s", resp.Header.Get("ETag"), resp.Header.Get("Content-Length")), nil
+}
+
+// layerExists returns true if an intermediate image of currNode exists in the image store from a previous build.
+// It first looks for an image whose recorded cache key (see cacheKeyForStep) matches exactly, and falls back to
+// checking the parent of the top layer of the image and the history for images built before cache keys existed.
+func (s *StageExecutor) layerExists(ctx context.Context, currNode *parser.Node, children []*parser.Node) (string, error) {
+	// Get the list of images available in the image store
+	images, err := s.executor.store.Images()
+	if err != nil {
+		return "", errors.Wrap(err, "error getting image list from store")
+	}
+
+	var expectedKey string
+	if s.builder != nil {
+		if key, err := s.cacheKeyForStep(s.builder.FromImageID, currNode, nil); err == nil {
+			expectedKey = key
+		}
+	}
+
+	for _, image := range images {
+		layer, err := s.executor.store.Layer(image.TopLayer)
+		if err != nil {
+			return "", errors.Wrapf(err, "error getting top layer info")
+		}
+		// If the parent of the top layer of an image is equal to the last entry in s.topLayers
+		// it means that this image is potentially a cached intermediate image from a previous
+		// build. Next we double check that the history of this image is equivalent to the previous
+		// lines in the Dockerfile up till the point we are at in the build.
+		if layer.Parent == s.topLayers[len(s.topLayers)-1] {
+			history, err := s.executor.getImageHistory(ctx, image.ID)
+			if err != nil {
+				return "", errors.Wrapf(err, "error getting history of %q", image.ID)
+			}
+			if expectedKey != "" {
+				if key, ok := extractCacheKeyComment(history[len(history)-1].CreatedBy); ok {
+					if key == expectedKey {
+						return image.ID, nil
+					}
+					// A recorded key that doesn't match is conclusive:
+					// don't bother falling through to the slower,
+					// less precise textual comparison below.
+					continue
+				}
+			}
+			// children + currNode is the point of the Dockerfile we are currently at.
+			if historyMatches(append(children, currNode), history) {
+				// This checks if the files copied during build have been changed if the node is
+				// a COPY or ADD command.
+				filesMatch, err := s.copiedFilesMatch(currNode, history[len(history)-1])
+				if err != nil {
+					return "", errors.Wrapf(err, "error checking if copied files match")
+				}
+				if filesMatch {
+					return image.ID, nil
+				}
+			}
+		}
+	}
+	if expectedKey != "" && len(s.executor.cacheFrom) > 0 {
+		imgID, err := s.pullRemoteCacheHit(ctx, expectedKey)
+		if err != nil {
+			logrus.Debugf("error checking remote build cache for %q: %v", expectedKey, err)
+		} else if imgID != "" {
+			return imgID, nil
+		}
+	}
+	return "", nil
+}
+
+// getImageHistory returns the history of imageID.
+func (b *Executor) getImageHistory(ctx context.Context, imageID string) ([]v1.History, error) {
+	imageRef, err := is.Transport.ParseStoreReference(b.store, "@"+imageID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting image reference %q", imageID)
+	}
+	ref, err := imageRef.NewImage(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating new image from reference")
+	}
+	oci, err := ref.OCIConfig(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting oci config of image %q", imageID)
+	}
+	return oci.History, nil
+}
+
+// getCreatedBy returns the command the image at node will be created by.
+func getCreatedBy(node *parser.Node) string {
+	if node.Value == "run" {
+		return "/bin/sh -c " + node.Original[4:]
+	}
+	return "/bin/sh -c #(nop) " + node.Original
+}
+
+// historyMatches returns true if the history of the image matches the lines
+// in the Dockerfile till the point of build we are at.
+// Used to verify whether a cache of the intermediate image exists and whether
+// to run the build again.
+func historyMatches(children []*parser.Node, history []v1.History) bool {
+	i := len(history) - 1
+	for j := len(children) - 1; j >= 0; j-- {
+		instruction := children[j].Original
+		if children[j].Value == "run" {
+			instruction = instruction[4:]
+		}
+		if !strings.Contains(history[i].CreatedBy, instruction) {
+			return false
+		}
+		i--
+	}
+	return true
+}
+
+// getFilesToCopy goes through node to get all the src files that are copied, added or downloaded.
+// It is possible for the Dockerfile to have src as hom*, which means all files that have hom as a prefix.
+// Another format is hom?.txt, which means all files that have that name format with the ? replaced by another character.
+func (s *StageExecutor) getFilesToCopy(node *parser.Node) ([]string, error) {
+	currNode := node.Next
+	var src []string
+	for currNode.Next != nil {
+		if strings.HasPrefix(currNode.Value, "http://") || strings.HasPrefix(currNode.Value, "https://") {
+			src = append(src, currNode.Value)
+			currNode = currNode.Next
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(s.copyFrom, currNode.Value))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error finding match for pattern %q", currNode.Value)
+		}
+		src = append(src, matches...)
+		currNode = currNode.Next
+	}
+	return src, nil
+}
+
+// copiedFilesMatch checks to see if the node instruction is a COPY or ADD, and if it is, whether the
+// files it would copy still match the ones the cached layer in history was built from. If history
+// carries a copyDigestAnnotation comment (see copiedFilesDigest), the current sources are digested
+// the same way and compared against it directly. That comment is only missing for images that were
+// cached before this existed, in which case we fall back to the previous mtime-based comparison
+// rather than force a rebuild of every image already sitting in the store.
+func (s *StageExecutor) copiedFilesMatch(node *parser.Node, history v1.History) (bool, error) {
+	if node.Value != "add" && node.Value != "copy" {
+		return true, nil
+	}
+
+	if expectedDigest, ok := extractCopyDigestComment(history.CreatedBy); ok {
+		digest, err := s.copiedFilesDigest(node)
+		if err != nil {
+			return false, err
+		}
+		return digest == expectedDigest, nil
+	}
+
+	historyTime := history.Created
+	src, err := s.getFilesToCopy(node)
+	if err != nil {
+		return false, err
 	}
 	for _, item := range src {
 		// for urls, check the Last-Modified field in the header.
@@ -1182,14 +2516,18 @@ func (s *StageExecutor) copiedFilesMatch(node *parser.Node, historyTime *time.Ti
 	return true, nil
 }
 
-// urlContentModified sends a get request to the url and checks if the header has a value in
-// Last-Modified, and if it does compares the time stamp to that of the history of the cached image.
-// returns true if there is no Last-Modified value in the header.
+// urlContentModified sends a HEAD request for url, rather than downloading the body the way we used
+// to, and checks if the header has a value in Last-Modified, and if it does compares the time stamp
+// to that of the history of the cached image. Returns true if there is no Last-Modified value in the
+// header. This only runs at all for sources that predate copyDigestAnnotation (see
+// copiedFilesMatch); anything built since then is compared by digest instead, without needing a
+// network round trip at all once the sources are unchanged.
 func urlContentModified(url string, historyTime *time.Time) (bool, error) {
-	resp, err := http.Get(url)
+	resp, err := http.Head(url)
 	if err != nil {
-		return false, errors.Wrapf(err, "error getting %q", url)
+		return false, errors.Wrapf(err, "error sending HEAD request to %q", url)
 	}
+	defer resp.Body.Close()
 	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
 		lastModifiedTime, err := time.Parse(time.RFC1123, lastModified)
 		if err != nil {
@@ -1197,7 +2535,7 @@ func urlContentModified(url string, historyTime *time.Time) (bool, error) {
 		}
 		return lastModifiedTime.After(*historyTime), nil
 	}
-	logrus.Debugf("Response header did not have Last-Modified %q, will rebuild.", url)
+	logrus.Debugf("Response to HEAD %q had no Last-Modified header, will rebuild.", url)
 	return true, nil
 }
 
@@ -1306,6 +2644,7 @@ func (s *StageExecutor) Commit(ctx context.Context, ib *imagebuilder.Builder, cr
 	if options.IIDFile == "" && imgID != "" {
 		fmt.Fprintf(s.executor.out, "--> %s\n", imgID)
 	}
+	s.executor.emit(progressEvent{Type: "commit", Stage: s.name, ImageID: imgID, Digest: manifestDigest.String()})
 	var ref reference.Canonical
 	if dref := imageRef.DockerReference(); dref != nil {
 		if ref, err = reference.WithDigest(dref, manifestDigest); err != nil {
@@ -1318,9 +2657,17 @@ func (s *StageExecutor) Commit(ctx context.Context, ib *imagebuilder.Builder, cr
 // Build takes care of the details of running Prepare/Execute/Commit/Delete
 // over each of the one or more parsed Dockerfiles and stages.
 func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (imageID string, ref reference.Canonical, err error) {
+	defer func() {
+		if err != nil {
+			b.emit(progressEvent{Type: "error", Message: err.Error()})
+		}
+	}()
 	if len(stages) == 0 {
 		return "", nil, errors.New("error building: no stages to build")
 	}
+	if b.jobs > 1 {
+		return b.buildConcurrent(ctx, stages)
+	}
 	var (
 		stageExecutor *StageExecutor
 		cleanupImages []string
@@ -1360,6 +2707,21 @@ func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (image
 			}
 		}
 		cleanupImages = nil
+		// Remove the per-step cache images we committed along the way,
+		// if the caller asked us not to keep them around as a cache for
+		// the next build.
+		if b.removeIntermediateImages {
+			for i := range b.intermediateImages {
+				removeID := b.intermediateImages[len(b.intermediateImages)-i-1]
+				if _, err := b.store.DeleteImage(removeID, true); err != nil {
+					logrus.Debugf("failed to remove intermediate cache image %q: %v", removeID, err)
+					if b.forceRmIntermediateCtrs || errors.Cause(err) != storage.ErrImageUsedByContainer {
+						lastErr = err
+					}
+				}
+			}
+		}
+		b.intermediateImages = nil
 		return lastErr
 	}
 	defer cleanup()
@@ -1382,6 +2744,7 @@ func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (image
 			output = b.output
 		}
 
+		stageStart := time.Now()
 		stageExecutor = b.startStage(stage.Name, stage.Position, len(stages), base, output)
 		if err := stageExecutor.Prepare(ctx, stage, base); err != nil {
 			return "", nil, err
@@ -1399,6 +2762,7 @@ func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (image
 		if lastErr != nil {
 			return "", nil, lastErr
 		}
+		b.emit(progressEvent{Type: "stage-end", Stage: stage.Name, Duration: time.Since(stageStart)})
 		if !b.forceRmIntermediateCtrs && b.removeIntermediateCtrs {
 			cleanupStages[stage.Position] = stageExecutor
 		}
@@ -1420,6 +2784,7 @@ func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (image
 		}
 		sort.Strings(unusedList)
 		fmt.Fprintf(b.out, "[Warning] one or more build args were not consumed: %v\n", unusedList)
+		b.emit(progressEvent{Type: "warning", Message: fmt.Sprintf("one or more build args were not consumed: %v", unusedList)})
 	}
 
 	// Check if we have a one line Dockerfile (i.e., single phase, no
@@ -1437,15 +2802,253 @@ func (b *Executor) Build(ctx context.Context, stages imagebuilder.Stages) (image
 		}
 	}
 
+	b.emitProvenance(ctx, stages, stageExecutor, imageID, ref)
+
+	if err := cleanup(); err != nil {
+		return "", nil, err
+	}
+
+	b.exportRemoteCache(ctx, imageID)
+
+	return imageID, ref, nil
+}
+
+// stageDependencies returns the indexes, into the slice that stageIndexByName was built from, of every
+// other stage that stage's FROM (base) or any of its COPY/ADD --from= flags names.
+func stageDependencies(stage imagebuilder.Stage, base string, stageIndexByName map[string]int) map[int]struct{} {
+	deps := make(map[int]struct{})
+	if idx, ok := stageIndexByName[base]; ok {
+		deps[idx] = struct{}{}
+	}
+	for _, child := range stage.Node.Children {
+		if child.Value != "copy" && child.Value != "add" {
+			continue
+		}
+		for _, flag := range child.Flags {
+			if !strings.HasPrefix(flag, "--from=") {
+				continue
+			}
+			name := strings.TrimPrefix(flag, "--from=")
+			if idx, ok := stageIndexByName[name]; ok {
+				deps[idx] = struct{}{}
+			}
+		}
+	}
+	return deps
+}
+
+// buildConcurrent is Build's implementation of BuildOptions.Jobs > 1: it runs every stage's goroutine up
+// front, but each one blocks on the StageExecutor.done channel of every stage named by its FROM or by a
+// COPY/ADD --from= before doing any work, so stages only actually run once their prerequisites have
+// committed, and unrelated stages run side by side. Concurrency is bounded by a semaphore sized to
+// b.jobs. Everything that Build's sequential loop mutates directly (b.stages, b.imageMap, b.unusedArgs,
+// the cleanup bookkeeping) is instead guarded by b.stageMutex or a local mutex here.
+func (b *Executor) buildConcurrent(ctx context.Context, stages imagebuilder.Stages) (string, reference.Canonical, error) {
+	stageIndexByName := make(map[string]int, len(stages)*2)
+	for i, stage := range stages {
+		stageIndexByName[stage.Name] = i
+		stageIndexByName[strconv.Itoa(stage.Position)] = i
+	}
+
+	executors := make([]*StageExecutor, len(stages))
+	deps := make([]map[int]struct{}, len(stages))
+	bases := make([]string, len(stages))
+	for i, stage := range stages {
+		base, err := stage.Builder.From(stage.Node)
+		if err != nil {
+			logrus.Debugf("buildConcurrent(node.Children=%#v)", stage.Node.Children)
+			return "", nil, err
+		}
+		bases[i] = base
+		deps[i] = stageDependencies(stage, base, stageIndexByName)
+		output := ""
+		if i == len(stages)-1 {
+			output = b.output
+		}
+		executors[i] = b.startStage(stage.Name, stage.Position, len(stages), base, output)
+	}
+
+	results := make([]struct {
+		imageID string
+		ref     reference.Canonical
+	}, len(stages))
+
+	var (
+		mu            sync.Mutex
+		cleanupStages = make(map[int]*StageExecutor)
+		cleanupImages []string
+		firstErr      error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	cleanup := func() error {
+		var lastErr error
+		for _, stage := range cleanupStages {
+			if err := stage.Delete(); err != nil {
+				logrus.Debugf("Failed to cleanup stage containers: %v", err)
+				lastErr = err
+			}
+		}
+		cleanupStages = nil
+		if b.removeIntermediateCtrs {
+			if err := b.deleteSuccessfulIntermediateCtrs(); err != nil {
+				logrus.Debugf("Failed to cleanup intermediate containers: %v", err)
+				lastErr = err
+			}
+		}
+		for i := range cleanupImages {
+			removeID := cleanupImages[len(cleanupImages)-i-1]
+			if _, err := b.store.DeleteImage(removeID, true); err != nil {
+				logrus.Debugf("failed to remove intermediate image %q: %v", removeID, err)
+				if b.forceRmIntermediateCtrs || errors.Cause(err) != storage.ErrImageUsedByContainer {
+					lastErr = err
+				}
+			}
+		}
+		cleanupImages = nil
+		if b.removeIntermediateImages {
+			for i := range b.intermediateImages {
+				removeID := b.intermediateImages[len(b.intermediateImages)-i-1]
+				if _, err := b.store.DeleteImage(removeID, true); err != nil {
+					logrus.Debugf("failed to remove intermediate cache image %q: %v", removeID, err)
+					if b.forceRmIntermediateCtrs || errors.Cause(err) != storage.ErrImageUsedByContainer {
+						lastErr = err
+					}
+				}
+			}
+		}
+		b.intermediateImages = nil
+		return lastErr
+	}
+	defer cleanup()
+
+	sem := make(chan struct{}, b.jobs)
+	var wg sync.WaitGroup
+	wg.Add(len(stages))
+	for i := range stages {
+		go func(i int) {
+			stage := stages[i]
+			se := executors[i]
+			defer wg.Done()
+			defer close(se.done)
+
+			for dep := range deps[i] {
+				<-executors[dep].done
+				if executors[dep].stageErr != nil {
+					se.stageErr = errors.Wrapf(executors[dep].stageErr, "stage %q depends on failed stage %q", stage.Name, stages[dep].Name)
+					fail(se.stageErr)
+					return
+				}
+			}
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			stageStart := time.Now()
+			if err := se.Prepare(ctx, stage, bases[i]); err != nil {
+				se.stageErr = err
+				fail(err)
+				return
+			}
+
+			mu.Lock()
+			if b.forceRmIntermediateCtrs || !b.layers {
+				cleanupStages[stage.Position] = se
+			}
+			mu.Unlock()
+
+			imgID, ref, err := se.Execute(ctx, stage)
+			if err != nil {
+				se.stageErr = err
+				fail(err)
+				return
+			}
+			b.emit(progressEvent{Type: "stage-end", Stage: stage.Name, Duration: time.Since(stageStart)})
+
+			mu.Lock()
+			if !b.forceRmIntermediateCtrs && b.removeIntermediateCtrs {
+				cleanupStages[stage.Position] = se
+			}
+			mu.Unlock()
+
+			// If this is an intermediate (named) stage, make a note to
+			// remove its image later, same as the sequential path does.
+			if _, err := strconv.Atoi(stage.Name); err != nil {
+				output := ""
+				if i == len(stages)-1 {
+					output = b.output
+				}
+				imgID, ref, err = se.Commit(ctx, stage.Builder, "", output)
+				if err != nil {
+					se.stageErr = err
+					fail(err)
+					return
+				}
+				b.stageMutex.Lock()
+				b.imageMap[stage.Name] = imgID
+				b.stageMutex.Unlock()
+				mu.Lock()
+				cleanupImages = append(cleanupImages, imgID)
+				mu.Unlock()
+			}
+			results[i].imageID, results[i].ref = imgID, ref
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return "", nil, firstErr
+	}
+
+	b.stageMutex.Lock()
+	unusedArgs := len(b.unusedArgs) > 0
+	unusedList := make([]string, 0, len(b.unusedArgs))
+	for k := range b.unusedArgs {
+		unusedList = append(unusedList, k)
+	}
+	b.stageMutex.Unlock()
+	if unusedArgs {
+		sort.Strings(unusedList)
+		fmt.Fprintf(b.out, "[Warning] one or more build args were not consumed: %v\n", unusedList)
+		b.emit(progressEvent{Type: "warning", Message: fmt.Sprintf("one or more build args were not consumed: %v", unusedList)})
+	}
+
+	last := len(stages) - 1
+	imageID, ref := results[last].imageID, results[last].ref
+
+	singleLineDockerfile := len(stages) < 2 && len(stages[0].Node.Children) < 1
+	ignoreLayers := singleLineDockerfile || !b.layers && b.useCache
+	if ignoreLayers {
+		var err error
+		if imageID, ref, err = executors[last].Commit(ctx, stages[last].Builder, "", b.output); err != nil {
+			return "", nil, err
+		}
+		if singleLineDockerfile {
+			b.log("COMMIT %s", ref)
+		}
+	}
+
+	b.emitProvenance(ctx, stages, executors[last], imageID, ref)
+
 	if err := cleanup(); err != nil {
 		return "", nil, err
 	}
 
+	b.exportRemoteCache(ctx, imageID)
+
 	return imageID, ref, nil
 }
 
 // BuildDockerfiles parses a set of one or more Dockerfiles (which may be
-// URLs), creates a new Executor, and then runs Prepare/Execute/Commit/Delete
+// local paths, http(s):// URLs, git repository URLs recognized by isGitURL,
+// or http(s):// URLs whose response is a tar or gzip-compressed tar archive),
+// creates a new Executor, and then runs Prepare/Execute/Commit/Delete
 // over the entire set of instructions.
 func BuildDockerfiles(ctx context.Context, store storage.Store, options BuildOptions, paths ...string) (string, reference.Canonical, error) {
 	if len(paths) == 0 {
@@ -1458,10 +3061,35 @@ func BuildDockerfiles(ctx context.Context, store storage.Store, options BuildOpt
 		}
 	}(dockerfiles...)
 
+	// tempDirCleanups removes any temporary directories created to hold a fetched git or
+	// tarball Dockerfile context, once we're done with them (i.e. after exec.Build returns,
+	// below). Executor has no cleanup hook of its own for this, so we run it here instead.
+	var tempDirCleanups []func()
+	defer func() {
+		for _, cleanup := range tempDirCleanups {
+			cleanup()
+		}
+	}()
+
 	for _, dfile := range paths {
 		var data io.ReadCloser
 
-		if strings.HasPrefix(dfile, "http://") || strings.HasPrefix(dfile, "https://") {
+		switch {
+		case isGitURL(dfile):
+			logrus.Debugf("fetching git Dockerfile context %q", dfile)
+			dir, cleanup, err := fetchGitContext(ctx, dfile)
+			if err != nil {
+				return "", nil, err
+			}
+			tempDirCleanups = append(tempDirCleanups, cleanup)
+			options.ContextDirectory = dir
+			dfile = filepath.Join(dir, "Dockerfile")
+			contents, err := os.Open(dfile)
+			if err != nil {
+				return "", nil, errors.Wrapf(err, "error reading %q", dfile)
+			}
+			data = contents
+		case strings.HasPrefix(dfile, "http://") || strings.HasPrefix(dfile, "https://"):
 			logrus.Debugf("reading remote Dockerfile %q", dfile)
 			resp, err := http.Get(dfile)
 			if err != nil {
@@ -1471,8 +3099,29 @@ func BuildDockerfiles(ctx context.Context, store storage.Store, options BuildOpt
 				resp.Body.Close()
 				return "", nil, errors.Errorf("no contents in %q", dfile)
 			}
-			data = resp.Body
-		} else {
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return "", nil, errors.Wrapf(err, "error getting %q", dfile)
+			}
+			if isTarballContentType(resp.Header.Get("Content-Type"), body) {
+				logrus.Debugf("fetching tarball Dockerfile context %q", dfile)
+				dir, cleanup, err := fetchTarballContext(bytes.NewReader(body))
+				if err != nil {
+					return "", nil, err
+				}
+				tempDirCleanups = append(tempDirCleanups, cleanup)
+				options.ContextDirectory = dir
+				dfile = filepath.Join(dir, "Dockerfile")
+				contents, err := os.Open(dfile)
+				if err != nil {
+					return "", nil, errors.Wrapf(err, "error reading %q", dfile)
+				}
+				data = contents
+			} else {
+				data = ioutil.NopCloser(bytes.NewReader(body))
+			}
+		default:
 			// If the Dockerfile isn't found try prepending the
 			// context directory to it.
 			dinfo, err := os.Stat(dfile)
@@ -1504,19 +3153,31 @@ func BuildDockerfiles(ctx context.Context, store storage.Store, options BuildOpt
 			data = contents
 		}
 
-		// pre-process Dockerfiles with ".in" suffix
-		if strings.HasSuffix(dfile, ".in") {
-			pData, err := preprocessDockerfileContents(data, options.ContextDirectory)
+		// run the Dockerfile through the first matching preprocessor, if any
+		preprocessors := options.Preprocessors
+		if len(preprocessors) == 0 {
+			preprocessors = defaultPreprocessors
+		}
+		for _, preprocessor := range preprocessors {
+			if !preprocessor.Match(dfile) {
+				continue
+			}
+			processed, err := preprocessor.Process(ctx, data, options.ContextDirectory)
+			data.Close()
 			if err != nil {
 				return "", nil, err
 			}
-			data = *pData
+			data = processed
+			break
 		}
 
 		dockerfiles = append(dockerfiles, data)
 	}
 
-	dockerfiles = processCopyFrom(dockerfiles)
+	dockerfileDigest, dockerfiles, err := hashAndRewrapDockerfiles(dockerfiles)
+	if err != nil {
+		return "", nil, err
+	}
 
 	mainNode, err := imagebuilder.ParseDockerfile(dockerfiles[0])
 	if err != nil {
@@ -1529,10 +3190,12 @@ func BuildDockerfiles(ctx context.Context, store storage.Store, options BuildOpt
 		}
 		mainNode.Children = append(mainNode.Children, additionalNode.Children...)
 	}
+	processCopyFrom(mainNode)
 	exec, err := NewExecutor(store, options)
 	if err != nil {
 		return "", nil, errors.Wrapf(err, "error creating build executor")
 	}
+	exec.dockerfileDigest = dockerfileDigest
 	b := imagebuilder.NewBuilder(options.Args)
 	stages, err := imagebuilder.NewStages(mainNode, b)
 	if err != nil {
@@ -1548,77 +3211,241 @@ func BuildDockerfiles(ctx context.Context, store storage.Store, options BuildOpt
 	return exec.Build(ctx, stages)
 }
 
-// processCopyFrom goes through the Dockerfiles and handles any 'COPY --from' instances
-// prepending a new FROM statement the Dockerfile that do not already have a corresponding
-// FROM command within them.
-func processCopyFrom(dockerfiles []io.ReadCloser) []io.ReadCloser {
-	var newDockerfiles []io.ReadCloser
-	// fromMap contains the names of the images seen in a FROM
-	// line in the Dockerfiles.  The boolean value just completes the map object.
-	fromMap := make(map[string]bool)
-	// asMap contains the names of the images seen after a "FROM image AS"
-	// line in the Dockefiles.  The boolean value just completes the map object.
-	asMap := make(map[string]bool)
-
-	copyRE := regexp.MustCompile(`\s*COPY\s+--from=`)
-	fromRE := regexp.MustCompile(`\s*FROM\s+`)
-	asRE := regexp.MustCompile(`(?i)\s+as\s+`)
-	for _, dfile := range dockerfiles {
-		if dfileBinary, err := ioutil.ReadAll(dfile); err == nil {
-			dfileString := fmt.Sprintf("%s", dfileBinary)
-			copyFromContent := copyRE.Split(dfileString, -1)
-			// no "COPY --from=", just continue
-			if len(copyFromContent) < 2 {
-				newDockerfiles = append(newDockerfiles, ioutil.NopCloser(strings.NewReader(dfileString)))
-				continue
+// hashAndRewrapDockerfiles reads every Dockerfile fully so their combined contents can be folded
+// into a single digest for build provenance (see buildProvenanceDocument), then hands back fresh
+// readers over the same bytes so the rest of BuildDockerfiles can still parse them normally.
+func hashAndRewrapDockerfiles(dockerfiles []io.ReadCloser) (string, []io.ReadCloser, error) {
+	h := sha256.New()
+	rewrapped := make([]io.ReadCloser, 0, len(dockerfiles))
+	for _, d := range dockerfiles {
+		contents, err := ioutil.ReadAll(d)
+		d.Close()
+		if err != nil {
+			return "", nil, errors.Wrap(err, "error reading Dockerfile contents")
+		}
+		h.Write(contents)
+		rewrapped = append(rewrapped, ioutil.NopCloser(bytes.NewReader(contents)))
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), rewrapped, nil
+}
+
+// gitURLPattern matches the "git://...", "git@host:path", and "github.com/user/repo" forms of
+// Dockerfile source accepted by BuildDockerfiles, each optionally followed by "#ref[:subdir]".
+var gitURLPattern = regexp.MustCompile(`^(git://|git@|(https?://)?github\.com/)`)
+
+// isGitURL reports whether dfile names a git repository rather than a plain file or HTTP(S) URL.
+func isGitURL(dfile string) bool {
+	return gitURLPattern.MatchString(dfile)
+}
+
+// splitGitFragment splits a "repo#ref:subdir" Dockerfile source into the repository URL, the ref
+// to check out (empty means the default branch), and the subdirectory to use as the context
+// within the checkout (empty means the checkout's root).
+func splitGitFragment(dfile string) (repo, ref, subdir string) {
+	repo = dfile
+	idx := strings.Index(dfile, "#")
+	if idx == -1 {
+		return repo, "", ""
+	}
+	repo = dfile[:idx]
+	fragment := dfile[idx+1:]
+	if c := strings.Index(fragment, ":"); c != -1 {
+		return repo, fragment[:c], fragment[c+1:]
+	}
+	return repo, fragment, ""
+}
+
+// fetchGitContext clones the repository named by dfile (a URL recognized by isGitURL) at its
+// requested ref into a fresh temporary directory using git(1), and returns the path to use as the
+// build context (the requested subdir within the checkout, or the checkout itself) along with a
+// function that removes the temporary directory once the caller is done with it.
+func fetchGitContext(ctx context.Context, dfile string) (string, func(), error) {
+	repo, ref, subdir := splitGitFragment(dfile)
+	if strings.HasPrefix(repo, "github.com/") {
+		repo = "https://" + repo
+	}
+	tempDir, err := ioutil.TempDir("", "buildah-git-context")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error creating temporary directory for git context")
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			logrus.Debugf("error removing temporary git context directory %q: %v", tempDir, err)
+		}
+	}
+	var stderr bytes.Buffer
+	clone := exec.CommandContext(ctx, "git", "clone", repo, tempDir)
+	clone.Stderr = &stderr
+	if err := clone.Run(); err != nil {
+		cleanup()
+		return "", nil, errors.Wrapf(err, "error cloning %q: %s", repo, strings.TrimSpace(stderr.String()))
+	}
+	if ref != "" {
+		stderr.Reset()
+		checkout := exec.CommandContext(ctx, "git", "-C", tempDir, "checkout", ref)
+		checkout.Stderr = &stderr
+		if err := checkout.Run(); err != nil {
+			cleanup()
+			return "", nil, errors.Wrapf(err, "error checking out %q from %q: %s", ref, repo, strings.TrimSpace(stderr.String()))
+		}
+	}
+	dir := tempDir
+	if subdir != "" {
+		dir = filepath.Join(tempDir, subdir)
+	}
+	return dir, cleanup, nil
+}
+
+// isTarballContentType reports whether contentType (as reported by an HTTP response) or the
+// magic bytes at the start of body indicate a tar or gzip-compressed tar archive, as opposed to a
+// plain-text Dockerfile.
+func isTarballContentType(contentType string, body []byte) bool {
+	switch contentType {
+	case "application/x-tar", "application/gzip", "application/x-gzip":
+		return true
+	}
+	if len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b {
+		return true // gzip magic number
+	}
+	if len(body) >= 262 && string(body[257:262]) == "ustar" {
+		return true // tar header magic, present at a fixed offset in every tar format
+	}
+	return false
+}
+
+// fetchTarballContext extracts the tar or gzip-compressed tar archive read from body into a
+// fresh temporary directory and returns its path, along with a function that removes the
+// temporary directory once the caller is done with it.
+func fetchTarballContext(body io.Reader) (string, func(), error) {
+	tempDir, err := ioutil.TempDir("", "buildah-tar-context")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error creating temporary directory for tarball context")
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			logrus.Debugf("error removing temporary tarball context directory %q: %v", tempDir, err)
+		}
+	}
+
+	reader := bufio.NewReader(body)
+	peek, _ := reader.Peek(2)
+	var tr *tar.Reader
+	if len(peek) == 2 && peek[0] == 0x1f && peek[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			cleanup()
+			return "", nil, errors.Wrap(err, "error reading gzip Dockerfile context")
+		}
+		defer gz.Close()
+		tr = tar.NewReader(gz)
+	} else {
+		tr = tar.NewReader(reader)
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return "", nil, errors.Wrap(err, "error reading Dockerfile context tarball")
+		}
+		target := filepath.Join(tempDir, filepath.Clean(string(filepath.Separator)+header.Name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				cleanup()
+				return "", nil, errors.Wrapf(err, "error creating %q", header.Name)
 			}
-			// Load all image names in our Dockerfiles into a map
-			// for easy reference later.
-			fromContent := fromRE.Split(dfileString, -1)
-			for i := 0; i < len(fromContent); i++ {
-				imageName := strings.Split(fromContent[i], " ")
-				if len(imageName) > 0 {
-					finalImage := strings.Split(imageName[0], "\n")
-					if finalImage[0] != "" {
-						fromMap[strings.TrimSpace(finalImage[0])] = true
-					}
-				}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				cleanup()
+				return "", nil, errors.Wrapf(err, "error creating %q", header.Name)
 			}
-			logrus.Debug("fromMap: ", fromMap)
-
-			// Load all image names associated with an 'as' or 'AS' in
-			// our Dockerfiles into a map for easy reference later.
-			asContent := asRE.Split(dfileString, -1)
-			// Skip the first entry in the array as it's stuff before
-			// the " as " and we don't care.
-			for i := 1; i < len(asContent); i++ {
-				asName := strings.Split(asContent[i], " ")
-				if len(asName) > 0 {
-					finalAsImage := strings.Split(asName[0], "\n")
-					if finalAsImage[0] != "" {
-						asMap[strings.TrimSpace(finalAsImage[0])] = true
-					}
-				}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode))
+			if err != nil {
+				cleanup()
+				return "", nil, errors.Wrapf(err, "error creating %q", header.Name)
 			}
-			logrus.Debug("asMap: ", asMap)
-
-			for i := 1; i < len(copyFromContent); i++ {
-				fromArray := strings.Split(copyFromContent[i], " ")
-				// If the image isn't a stage number or already declared,
-				// add a FROM statement for it to the top of our Dockerfile.
-				trimmedFrom := strings.TrimSpace(fromArray[0])
-				_, okFrom := fromMap[trimmedFrom]
-				_, okAs := asMap[trimmedFrom]
-				_, err := strconv.Atoi(trimmedFrom)
-				if !okFrom && !okAs && err != nil {
-					from := "FROM " + trimmedFrom
-					newDockerfiles = append(newDockerfiles, ioutil.NopCloser(strings.NewReader(from)))
-				}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				cleanup()
+				return "", nil, errors.Wrapf(err, "error extracting %q", header.Name)
+			}
+			out.Close()
+		}
+	}
+	return tempDir, cleanup, nil
+}
+
+// processCopyFrom walks node (the combined, already-parsed Dockerfile AST) and, for every
+// COPY/ADD --from= flag whose target isn't a numeric stage index and doesn't name a stage
+// introduced by any FROM (or FROM ... AS <name>) in node, synthesizes a "FROM <target>" node and
+// prepends it to node.Children as a new, anonymous stage.
+//
+// This operates on parser.Node instead of the raw Dockerfile text specifically so it isn't
+// tripped up by line continuations, comments, quoting, or --from= values that only resolve once
+// earlier stages are taken into account -- all things the regexp-based version this replaced got
+// wrong.
+func processCopyFrom(node *parser.Node) {
+	stageNames := make(map[string]bool)
+	for _, child := range node.Children {
+		if !strings.EqualFold(child.Value, "from") {
+			continue
+		}
+		words := stageWords(child)
+		if len(words) == 0 {
+			continue
+		}
+		stageNames[strings.TrimSpace(words[0])] = true
+		for i := 0; i+1 < len(words); i++ {
+			if strings.EqualFold(words[i], "as") {
+				stageNames[strings.TrimSpace(words[i+1])] = true
+			}
+		}
+	}
+	logrus.Debugf("processCopyFrom: stage names/aliases: %v", stageNames)
+
+	var newStages []*parser.Node
+	for _, child := range node.Children {
+		if child.Value != "copy" && child.Value != "add" {
+			continue
+		}
+		for _, flag := range child.Flags {
+			if !strings.HasPrefix(flag, "--from=") {
+				continue
+			}
+			target := strings.TrimSpace(strings.TrimPrefix(flag, "--from="))
+			if target == "" || stageNames[target] {
+				continue
 			}
-			newDockerfiles = append(newDockerfiles, ioutil.NopCloser(strings.NewReader(dfileString)))
-		} // End if dfileBinary, err := ioutil.ReadAll(dfile); err == nil
-	} // End for _, dfile := range dockerfiles {
-	return newDockerfiles
+			if _, err := strconv.Atoi(target); err == nil {
+				continue
+			}
+			// Mark it resolved immediately, so that a second COPY --from= naming the
+			// same not-yet-declared stage doesn't get a duplicate FROM prepended.
+			stageNames[target] = true
+			newStages = append(newStages, &parser.Node{
+				Value:    "from",
+				Original: "FROM " + target,
+				Next:     &parser.Node{Value: target},
+			})
+		}
+	}
+	if len(newStages) > 0 {
+		node.Children = append(newStages, node.Children...)
+	}
+}
+
+// stageWords collects the space-separated words of a parsed instruction by walking its Next
+// chain, the same token stream imagebuilder's own dispatchers use, so that "FROM x AS y" can be
+// recognized without re-splitting the instruction's raw text.
+func stageWords(node *parser.Node) []string {
+	var words []string
+	for n := node.Next; n != nil; n = n.Next {
+		words = append(words, n.Value)
+	}
+	return words
 }
 
 // deleteSuccessfulIntermediateCtrs goes through the container IDs in each
@@ -1653,6 +3480,108 @@ func (s *StageExecutor) EnsureContainerPath(path string) error {
 	return nil
 }
 
+// Preprocessor lets a caller plug in a macro/templating engine of its own choosing to expand a
+// Dockerfile's contents before it's handed to imagebuilder.ParseDockerfile. Match is consulted with
+// the Dockerfile's path (as passed to BuildDockerfiles) to decide whether this Preprocessor applies;
+// Process is then called with the unexpanded contents and the build's context directory.
+type Preprocessor interface {
+	Match(path string) bool
+	Process(ctx context.Context, r io.Reader, ctxDir string) (io.ReadCloser, error)
+}
+
+// defaultPreprocessors is used whenever BuildOptions.Preprocessors is empty, preserving this
+// package's previous, unconditional CPP-on-".in" behavior.
+var defaultPreprocessors = []Preprocessor{cppPreprocessor{}}
+
+// cppPreprocessor is the original ".in" preprocessor, which shells out to CPP(1).
+type cppPreprocessor struct{}
+
+func (cppPreprocessor) Match(path string) bool {
+	return strings.HasSuffix(path, ".in")
+}
+
+func (cppPreprocessor) Process(ctx context.Context, r io.Reader, ctxDir string) (io.ReadCloser, error) {
+	rdrCloser, err := preprocessDockerfileContents(ioutil.NopCloser(r), ctxDir)
+	if err != nil {
+		return nil, err
+	}
+	return *rdrCloser, nil
+}
+
+// templateContext is the data made available to a TemplatePreprocessor's templates.
+type templateContext struct {
+	Args     map[string]string
+	Env      map[string]string
+	Platform string
+}
+
+// TemplatePreprocessor expands Dockerfiles with a ".tmpl" suffix using Go's text/template, with
+// .Args (the preprocessor's own Args field), .Env (the process environment), and .Platform (GOOS/GOARCH) available
+// to the template.
+type TemplatePreprocessor struct {
+	Args map[string]string
+}
+
+func (TemplatePreprocessor) Match(path string) bool {
+	return strings.HasSuffix(path, ".tmpl")
+}
+
+func (p TemplatePreprocessor) Process(ctx context.Context, r io.Reader, ctxDir string) (io.ReadCloser, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading Dockerfile template")
+	}
+	tmpl, err := template.New("Dockerfile").Parse(string(contents))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing Dockerfile template")
+	}
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	data := templateContext{
+		Args:     p.Args,
+		Env:      env,
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, errors.Wrapf(err, "error executing Dockerfile template")
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+// envsubstPattern matches a "${VAR}" or "$VAR" reference for EnvsubstPreprocessor.
+var envsubstPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// EnvsubstPreprocessor expands Dockerfiles with a ".envsubst" suffix by replacing "${VAR}" and
+// "$VAR" references with the corresponding value from Args, leaving unknown references untouched.
+type EnvsubstPreprocessor struct {
+	Args map[string]string
+}
+
+func (EnvsubstPreprocessor) Match(path string) bool {
+	return strings.HasSuffix(path, ".envsubst")
+}
+
+func (p EnvsubstPreprocessor) Process(ctx context.Context, r io.Reader, ctxDir string) (io.ReadCloser, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading Dockerfile for envsubst expansion")
+	}
+	expanded := envsubstPattern.ReplaceAllStringFunc(string(contents), func(match string) string {
+		name := strings.TrimSuffix(strings.TrimPrefix(match, "${"), "}")
+		name = strings.TrimPrefix(name, "$")
+		if value, ok := p.Args[name]; ok {
+			return value
+		}
+		return match
+	})
+	return ioutil.NopCloser(strings.NewReader(expanded)), nil
+}
+
 // preprocessDockerfileContents runs CPP(1) in preprocess-only mode on the input
 // dockerfile content and will use ctxDir as the base include path.
 //
@@ -0,0 +1,56 @@
+package imagebuildah
+
+import (
+	"testing"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+func TestCacheKeyCommentRoundTrip(t *testing.T) {
+	createdBy := getCreatedBy(&parser.Node{Value: "run", Original: "RUN echo hi"}) + cacheKeyComment("abc123")
+	key, ok := extractCacheKeyComment(createdBy)
+	if !ok || key != "abc123" {
+		t.Fatalf("extractCacheKeyComment(%q) = (%q, %v), want (\"abc123\", true)", createdBy, key, ok)
+	}
+}
+
+func TestExtractCacheKeyCommentMissing(t *testing.T) {
+	if _, ok := extractCacheKeyComment("/bin/sh -c #(nop) RUN echo hi"); ok {
+		t.Fatal("expected no cache key comment to be found")
+	}
+}
+
+func TestCopyDigestCommentRoundTrip(t *testing.T) {
+	createdBy := getCreatedBy(&parser.Node{Value: "copy", Original: "COPY a b"}) + copyDigestComment("deadbeef")
+	digest, ok := extractCopyDigestComment(createdBy)
+	if !ok || digest != "deadbeef" {
+		t.Fatalf("extractCopyDigestComment(%q) = (%q, %v), want (\"deadbeef\", true)", createdBy, digest, ok)
+	}
+}
+
+func TestGetCreatedBy(t *testing.T) {
+	if got := getCreatedBy(&parser.Node{Value: "copy", Original: "COPY a b"}); got != "/bin/sh -c #(nop) COPY a b" {
+		t.Fatalf("getCreatedBy(COPY) = %q", got)
+	}
+	if got := getCreatedBy(&parser.Node{Value: "run", Original: "RUN echo hi"}); got != "/bin/sh -c echo hi" {
+		t.Fatalf("getCreatedBy(RUN) = %q", got)
+	}
+}
+
+func TestHistoryMatches(t *testing.T) {
+	history := []v1.History{
+		{CreatedBy: "/bin/sh -c #(nop) FROM scratch"},
+		{CreatedBy: "/bin/sh -c echo hi"},
+	}
+	children := []*parser.Node{
+		{Value: "run", Original: "RUN echo hi"},
+	}
+	if !historyMatches(children, history) {
+		t.Fatal("expected history to match")
+	}
+	children[0].Original = "RUN echo bye"
+	if historyMatches(children, history) {
+		t.Fatal("expected a changed instruction not to match")
+	}
+}